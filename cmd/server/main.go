@@ -1,15 +1,28 @@
 package main
 
 import (
+	"context"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"pushem/internal/api"
+	"pushem/internal/auth"
+	"pushem/internal/callback"
 	"pushem/internal/db"
+	"pushem/internal/fcm"
+	"pushem/internal/filecache"
+	"pushem/internal/limiter"
+	"pushem/internal/mailgateway"
+	"pushem/internal/metrics"
+	"pushem/internal/stream"
+	"pushem/internal/tlsmgr"
 	"pushem/internal/webpush"
 
 	"github.com/go-chi/chi/v5"
@@ -17,14 +30,21 @@ import (
 	"github.com/go-chi/cors"
 )
 
-func startMessageCleanup(database *db.DB) {
-	// Get configuration from environment variables
+// messageRetentionDays reads MESSAGE_RETENTION_DAYS, defaulting to 7. It's
+// shared by startMessageCleanup and the attachment cache's expiry window,
+// so attachments expire alongside the message that referenced them.
+func messageRetentionDays() int {
 	retentionDays := 7 // Default: keep messages for 7 days
 	if days := os.Getenv("MESSAGE_RETENTION_DAYS"); days != "" {
 		if parsed, err := strconv.Atoi(days); err == nil && parsed > 0 {
 			retentionDays = parsed
 		}
 	}
+	return retentionDays
+}
+
+func startMessageCleanup(database *db.DB, attachments filecache.Cache) {
+	retentionDays := messageRetentionDays()
 
 	cleanupInterval := 24 * time.Hour // Default: run cleanup once per day
 	if hours := os.Getenv("CLEANUP_INTERVAL_HOURS"); hours != "" {
@@ -33,7 +53,7 @@ func startMessageCleanup(database *db.DB) {
 		}
 	}
 
-	log.Printf("Message cleanup: retention=%d days, interval=%v", retentionDays, cleanupInterval)
+	slog.Info("message cleanup configured", "retention_days", retentionDays, "interval", cleanupInterval)
 
 	// Run cleanup in background
 	go func() {
@@ -46,46 +66,143 @@ func startMessageCleanup(database *db.DB) {
 		for {
 			count, err := database.DeleteOldMessages(retentionDays)
 			if err != nil {
-				log.Printf("Error during message cleanup: %v", err)
+				slog.Error("message cleanup failed", "error", err)
 			} else if count > 0 {
-				log.Printf("Cleaned up %d old messages (older than %d days)", count, retentionDays)
+				slog.Info("message cleanup completed", "deleted", count, "retention_days", retentionDays)
 
-				// Log current message count
 				if total, err := database.GetMessageCount(); err == nil {
-					log.Printf("Current message count: %d", total)
+					slog.Info("message count", "total", total)
+				}
+			}
+
+			if attachments != nil {
+				if removed, err := attachments.Sweep(context.Background(), time.Now()); err != nil {
+					slog.Error("attachment cleanup failed", "error", err)
+				} else if removed > 0 {
+					slog.Info("attachment cleanup completed", "deleted", removed)
 				}
 			}
 
+			if count, err := database.DeleteExpiredMessagesForTiers(); err != nil {
+				slog.Error("tiered message cleanup failed", "error", err)
+			} else if count > 0 {
+				slog.Info("tiered message cleanup completed", "deleted", count)
+			}
+
+			if count, err := database.DeleteExpiredMessagesForTopics(); err != nil {
+				slog.Error("per-topic retention cleanup failed", "error", err)
+			} else if count > 0 {
+				slog.Info("per-topic retention cleanup completed", "deleted", count)
+			}
+
+			if attachments != nil {
+				sweepExpiredAttachmentRecords(database, attachments)
+			}
+
 			<-ticker.C
 		}
 	}()
 }
 
-func main() {
-	log.Println("Starting Pushem Server...")
+// sweepExpiredAttachmentRecords deletes every attachment the janitor
+// finds past its attachment_expires from attachments, then marks its
+// message row attachment_deleted so it stops counting against anyone's
+// tier attachment-total-size quota. Deleting an already-gone id is not an
+// error, so a failed MarkAttachmentDeleted just retries on the next pass.
+func sweepExpiredAttachmentRecords(database *db.DB, attachments filecache.Cache) {
+	expired, err := database.SelectAttachmentsExpired()
+	if err != nil {
+		slog.Error("failed to list expired attachments", "error", err)
+		return
+	}
+
+	for _, msg := range expired {
+		if err := attachments.Delete(context.Background(), msg.AttachmentID); err != nil {
+			slog.Error("failed to delete expired attachment", "id", msg.AttachmentID, "error", err)
+			continue
+		}
+		if err := database.MarkAttachmentDeleted(msg.ID); err != nil {
+			slog.Error("failed to mark attachment deleted", "message_id", msg.ID, "error", err)
+		}
+	}
+}
+
+// waitForShutdownSignal blocks until the process receives SIGINT or
+// SIGTERM, then closes streamHub so every live SSE/WebSocket/JSON
+// subscriber goroutine unblocks and its connection closes, instead of
+// leaking until the OS kills it.
+func waitForShutdownSignal(streamHub *stream.Hub) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 
+	sig := <-sigCh
+	slog.Info("shutting down", "signal", sig)
+	streamHub.Close()
+	os.Exit(0)
+}
+
+func main() {
 	database, err := db.New("pushem.db")
 	if err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
 	defer database.Close()
-	log.Println("Database initialized")
+
+	// `pushem user ...` manages accounts and access tokens instead of
+	// starting the server.
+	if len(os.Args) > 1 && os.Args[1] == "user" {
+		if err := runUserCommand(os.Args[2:], database); err != nil {
+			log.Fatalf("%v", err)
+		}
+		return
+	}
+
+	// `pushem tier ...` manages rate/quota tiers and their assignment to
+	// users instead of starting the server.
+	if len(os.Args) > 1 && os.Args[1] == "tier" {
+		if err := runTierCommand(os.Args[2:], database); err != nil {
+			log.Fatalf("%v", err)
+		}
+		return
+	}
+
+	slog.Info("starting pushem server")
+	slog.Info("database initialized")
 
 	webpushService, err := webpush.NewService()
 	if err != nil {
 		log.Fatalf("Failed to initialize webpush service: %v", err)
 	}
-	log.Println("Web Push service initialized")
+	slog.Info("web push service initialized")
+
+	fcmService, err := fcm.NewService(fcm.LoadConfigFromEnv())
+	if err != nil {
+		log.Fatalf("Failed to initialize fcm service: %v", err)
+	}
+	if fcmService == nil {
+		slog.Warn("FIREBASE_CREDENTIALS not set, FCM delivery will be disabled")
+	}
+
+	callbackService := callback.NewService()
+
+	attachmentCache, err := filecache.NewFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to initialize attachment cache: %v", err)
+	}
+	if attachmentCache == nil {
+		slog.Warn("no ATTACHMENT_CACHE_DIR or ATTACHMENT_S3_BUCKET set, PUT /publish/{topic} attachments will be disabled")
+	}
+	attachmentRetention := time.Duration(messageRetentionDays()) * 24 * time.Hour
 
 	// Start message cleanup goroutine
-	startMessageCleanup(database)
+	startMessageCleanup(database, attachmentCache)
 
 	// Get admin password from environment
 	adminPassword := os.Getenv("ADMIN_PASSWORD")
 	if adminPassword == "" {
-		log.Println("Warning: ADMIN_PASSWORD not set. Admin panel will be disabled.")
+		slog.Warn("ADMIN_PASSWORD not set, admin panel will be disabled")
 	} else {
-		log.Println("Admin panel enabled with token-based authentication")
+		slog.Info("admin panel enabled with token-based authentication")
 	}
 
 	// Get token expiry configuration (in minutes)
@@ -96,12 +213,72 @@ func main() {
 		}
 	}
 
-	handler := api.NewHandler(database, webpushService, adminPassword, tokenExpiryMinutes)
+	// Get login rate-limit configuration
+	maxLoginAttempts := 5 // Default: 5 attempts
+	if max := os.Getenv("ADMIN_LOGIN_MAX_ATTEMPTS"); max != "" {
+		if parsed, err := strconv.Atoi(max); err == nil && parsed > 0 {
+			maxLoginAttempts = parsed
+		}
+	}
+
+	loginRateLimitWindow := 15 // Default: 15 minute window
+	if window := os.Getenv("ADMIN_LOGIN_RATE_LIMIT_WINDOW_MINUTES"); window != "" {
+		if parsed, err := strconv.Atoi(window); err == nil && parsed > 0 {
+			loginRateLimitWindow = parsed
+		}
+	}
+
+	defaultPolicy := auth.DefaultPolicy(os.Getenv("DEFAULT_TOPIC_POLICY"))
+	if defaultPolicy == "" {
+		defaultPolicy = auth.PolicyOpen
+	}
+	slog.Info("default topic policy", "policy", defaultPolicy)
+
+	streamHub := stream.NewHub()
+	go waitForShutdownSignal(streamHub)
+	authManager := auth.NewManager(database, defaultPolicy)
+	limiterConfig := limiter.LoadConfigFromEnv()
+	limiterConfig.AdminCheck = authManager.IsAdminRequest
+	visitorLimiter := limiter.New(limiterConfig)
+
+	handler := api.NewHandler(database, webpushService, fcmService, callbackService, streamHub, attachmentCache, attachmentRetention, adminPassword, tokenExpiryMinutes, maxLoginAttempts, loginRateLimitWindow, authManager.RecordTopicOwner, authManager.IdentifyUser, authManager.CheckAttachmentQuota)
+	streamHandler := stream.NewHandler(streamHub, database, handler.CheckAuth)
+
+	go metrics.StartCollector(database, streamHub, visitorLimiter.VisitorCount, 15*time.Second)
+
+	// Metrics are served on a separate listener, guarded by an IP
+	// allow-list, so operators can keep /metrics off the public-facing API
+	// entirely. Without METRICS_LISTEN_ADDR set, /metrics is instead
+	// mounted on the main router below, guarded by the admin JWT.
+	mountMetricsOnMainRouter := true
+	if metricsAddr := os.Getenv("METRICS_LISTEN_ADDR"); metricsAddr != "" {
+		go metrics.ListenAndServe(metricsAddr, metrics.LoadConfigFromEnv())
+		mountMetricsOnMainRouter = false
+	}
+
+	// The SMTP gateway lets alerting systems that only speak email (e.g.
+	// Alertmanager's email receiver) publish by sending mail, reusing
+	// Publish's own fan-out path.
+	if mailCfg := mailgateway.LoadConfigFromEnv(); mailCfg.Enabled() {
+		gateway := mailgateway.New(mailCfg, handler.Publish)
+		go func() {
+			if err := gateway.ListenAndServe(); err != nil {
+				slog.Error("SMTP gateway stopped", "error", err)
+			}
+		}()
+	}
 
 	r := chi.NewRouter()
 
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
+	r.Use(metrics.Middleware(func(req *http.Request) string {
+		rctx := chi.RouteContext(req.Context())
+		if rctx != nil && rctx.RoutePattern() != "" {
+			return rctx.RoutePattern()
+		}
+		return req.URL.Path
+	}))
 
 	// Configure CORS from environment variable
 	allowedOrigins := []string{"http://localhost:*", "https://localhost:*"}
@@ -115,9 +292,9 @@ func main() {
 				allowedOrigins = append(allowedOrigins, trimmed)
 			}
 		}
-		log.Printf("CORS configured for origins: %v", allowedOrigins)
+		slog.Info("cors configured", "origins", allowedOrigins)
 	} else {
-		log.Printf("CORS: Using default (localhost only). Set CORS_ORIGINS for production.")
+		slog.Info("cors using default localhost-only origins, set CORS_ORIGINS for production")
 	}
 
 	r.Use(cors.Handler(cors.Options{
@@ -130,11 +307,25 @@ func main() {
 	}))
 
 	r.Get("/vapid-public-key", handler.GetVAPIDPublicKey)
-	r.Post("/subscribe/{topic}", handler.Subscribe)
-	r.Post("/publish/{topic}", handler.Publish)
-	r.Get("/history/{topic}", handler.GetHistory)
-	r.Delete("/history/{topic}", handler.ClearHistory)
+	r.With(visitorLimiter.RequestLimit, visitorLimiter.SubscribeLimit, authManager.RequirePermission(auth.PermissionRead), authManager.EnforceSubscribeTier).Post("/subscribe/{topic}", handler.Subscribe)
+	r.With(visitorLimiter.RequestLimit, visitorLimiter.SubscribeLimit, authManager.RequirePermission(auth.PermissionRead), authManager.EnforceSubscribeTier).Post("/subscribe/{topic}/fcm", handler.SubscribeFCM)
+	r.With(visitorLimiter.RequestLimit, visitorLimiter.SubscribeLimit, authManager.RequirePermission(auth.PermissionRead), authManager.EnforceSubscribeTier).Post("/subscribe/{topic}/callback", handler.SubscribeCallback)
+	r.With(visitorLimiter.RequestLimit, visitorLimiter.PublishLimit, authManager.RequirePermission(auth.PermissionWrite), authManager.EnforcePublishTier).Post("/publish/{topic}", handler.Publish)
+	r.With(visitorLimiter.RequestLimit, visitorLimiter.UploadLimit, authManager.RequirePermission(auth.PermissionWrite), authManager.EnforcePublishTier).Put("/publish/{topic}", handler.PublishAttachment)
+	r.With(visitorLimiter.RequestLimit, visitorLimiter.HistoryLimit, authManager.RequirePermission(auth.PermissionRead)).Get("/history/{topic}", handler.GetHistory)
+	r.With(visitorLimiter.RequestLimit, visitorLimiter.HistoryLimit, authManager.RequirePermission(auth.PermissionWrite)).Delete("/history/{topic}", handler.ClearHistory)
+	r.Get("/v1/account", visitorLimiter.AccountHandler)
+	r.Post("/v1/account/token", authManager.ServeAccountToken)
+	r.With(visitorLimiter.RequestLimit, visitorLimiter.StreamLimit, authManager.RequirePermission(auth.PermissionRead)).Get("/{topic}/ws", streamHandler.ServeWS)
+	r.With(visitorLimiter.RequestLimit, visitorLimiter.StreamLimit, authManager.RequirePermission(auth.PermissionRead)).Get("/{topic}/sse", streamHandler.ServeSSE)
+	r.With(visitorLimiter.RequestLimit, visitorLimiter.StreamLimit, authManager.RequirePermission(auth.PermissionRead)).Get("/{topic}/json", streamHandler.ServeJSON)
 	r.Post("/topics/{topic}/protect", handler.ProtectTopic)
+	r.With(visitorLimiter.RequestLimit).Get("/file/{id}", handler.GetAttachment)
+	if mountMetricsOnMainRouter {
+		r.With(handler.RequireAdmin).Get("/metrics", func(w http.ResponseWriter, r *http.Request) {
+			metrics.Handler().ServeHTTP(w, r)
+		})
+	}
 
 	// Admin routes
 	r.Route("/api/admin", func(r chi.Router) {
@@ -147,6 +338,12 @@ func main() {
 			r.Get("/topics", handler.AdminListTopics)
 			r.Delete("/topics/{topic}", handler.AdminDeleteTopic)
 			r.Delete("/topics/{topic}/protection", handler.AdminUnprotectTopic)
+			r.Get("/users", authManager.ServeListUsers)
+			r.Post("/users", authManager.ServeCreateUser)
+			r.Delete("/users/{username}", authManager.ServeDeleteUser)
+			r.Post("/users/{username}/tier", authManager.ServeAssignTier)
+			r.Get("/tiers", authManager.ServeListTiers)
+			r.Post("/tiers", authManager.ServeCreateTier)
 		})
 	})
 
@@ -155,7 +352,7 @@ func main() {
 		staticDir = "web/dist"
 	}
 	if _, err := os.Stat(staticDir); os.IsNotExist(err) {
-		log.Printf("Warning: Frontend directory '%s' not found. Frontend will not be available.", staticDir)
+		slog.Warn("frontend directory not found, frontend will not be available", "dir", staticDir)
 	} else {
 		fileServer := http.FileServer(http.Dir(staticDir))
 		r.Get("/*", func(w http.ResponseWriter, req *http.Request) {
@@ -166,7 +363,28 @@ func main() {
 			}
 			http.StripPrefix("/", fileServer).ServeHTTP(w, req)
 		})
-		log.Printf("Serving frontend from '%s'", staticDir)
+		slog.Info("serving frontend", "dir", staticDir)
+	}
+
+	tlsCfg := tlsmgr.LoadConfigFromEnv()
+	if tlsCfg.Enabled() {
+		tlsManager, err := tlsmgr.New(tlsCfg)
+		if err != nil {
+			log.Fatalf("Failed to initialize TLS: %v", err)
+		}
+
+		go func() {
+			slog.Info("redirecting http (:80) to https")
+			if err := tlsManager.RedirectHTTP(); err != nil {
+				slog.Error("http redirect listener failed", "error", err)
+			}
+		}()
+
+		slog.Info("server listening", "addr", tlsCfg.ListenHTTPS, "tls", true)
+		if err := tlsManager.ListenAndServeTLS(r); err != nil {
+			log.Fatalf("Server failed: %v", err)
+		}
+		return
 	}
 
 	port := os.Getenv("PORT")
@@ -174,11 +392,7 @@ func main() {
 		port = "8080"
 	}
 
-	log.Printf("Server listening on :%s", port)
-	log.Printf("API endpoints:")
-	log.Printf("  GET  /vapid-public-key")
-	log.Printf("  POST /subscribe/{topic}")
-	log.Printf("  POST /publish/{topic}")
+	slog.Info("server listening", "port", port)
 
 	if err := http.ListenAndServe(":"+port, r); err != nil {
 		log.Fatalf("Server failed: %v", err)
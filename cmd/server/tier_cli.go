@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"pushem/internal/auth"
+	"pushem/internal/db"
+)
+
+// runTierCommand implements the `pushem tier ...` subcommands for
+// defining rate/quota tiers and assigning them to users.
+func runTierCommand(args []string, database *db.DB) error {
+	manager := auth.NewManager(database, auth.PolicyOpen)
+
+	if len(args) == 0 {
+		return fmt.Errorf("usage: pushem tier <add|list|assign> ...")
+	}
+
+	switch args[0] {
+	case "add":
+		if len(args) != 9 {
+			return fmt.Errorf("usage: pushem tier add <code> <name> <messages-limit> <messages-expiry-days> <subscriptions-limit> <publish-rate-per-hour> <attachment-file-size-limit> <attachment-total-size-limit>")
+		}
+		id, err := database.CreateTier(args[1], args[2], parseTierLimit(args[3]), parseTierLimit(args[4]), parseTierLimit(args[5]), parseTierLimit(args[6]), parseTierByteLimit(args[7]), parseTierByteLimit(args[8]))
+		if err != nil {
+			return fmt.Errorf("failed to create tier: %w", err)
+		}
+		fmt.Printf("created tier %q (%s)\n", args[1], id)
+		return nil
+
+	case "list":
+		tiers, err := database.ListTiers()
+		if err != nil {
+			return fmt.Errorf("failed to list tiers: %w", err)
+		}
+		for _, t := range tiers {
+			fmt.Printf("%s\t%s\tmessages=%d\texpiry_days=%d\tsubscriptions=%d\tpublish_rate_per_hour=%d\tattachment_file_size_limit=%d\tattachment_total_size_limit=%d\n",
+				t.Code, t.Name, t.MessagesLimit, t.MessagesExpiryDays, t.SubscriptionsLimit, t.PublishRatePerHour, t.AttachmentFileSizeLimit, t.AttachmentTotalSizeLimit)
+		}
+		return nil
+
+	case "assign":
+		if len(args) != 3 {
+			return fmt.Errorf("usage: pushem tier assign <username> <tier-code>")
+		}
+		if err := manager.AssignTierByCode(args[1], args[2]); err != nil {
+			return fmt.Errorf("failed to assign tier: %w", err)
+		}
+		fmt.Printf("assigned tier %q to user %q\n", args[2], args[1])
+		return nil
+
+	default:
+		return fmt.Errorf("unknown tier subcommand %q: usage: pushem tier <add|list|assign> ...", args[0])
+	}
+}
+
+// parseTierLimit parses a tier limit argument, treating a bad value as 0
+// (unlimited) the same way CreateTier's defaults do.
+func parseTierLimit(s string) int {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// parseTierByteLimit parses a tier byte-limit argument (attachment size
+// limits), treating a bad value as 0 (unlimited) the same as
+// parseTierLimit.
+func parseTierByteLimit(s string) int64 {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return n
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+
+	"pushem/internal/auth"
+	"pushem/internal/db"
+)
+
+// runUserCommand implements the `pushem user ...` subcommands for
+// managing accounts and the bearer tokens that grant them topic access.
+func runUserCommand(args []string, database *db.DB) error {
+	manager := auth.NewManager(database, auth.PolicyOpen)
+
+	if len(args) == 0 {
+		return fmt.Errorf("usage: pushem user <add|remove|list|change-pass|access> ...")
+	}
+
+	switch args[0] {
+	case "add":
+		if len(args) != 3 && len(args) != 4 {
+			return fmt.Errorf("usage: pushem user add <username> <password> [admin|user]")
+		}
+		role := auth.RoleUser
+		if len(args) == 4 {
+			role = auth.Role(args[3])
+			if role != auth.RoleUser && role != auth.RoleAdmin {
+				return fmt.Errorf("role must be one of: user, admin")
+			}
+		}
+		if err := manager.CreateUser(args[1], args[2], role); err != nil {
+			return fmt.Errorf("failed to create user: %w", err)
+		}
+		fmt.Printf("created %s user %q\n", role, args[1])
+		return nil
+
+	case "remove":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: pushem user remove <username>")
+		}
+		if err := manager.DeleteUser(args[1]); err != nil {
+			return fmt.Errorf("failed to remove user: %w", err)
+		}
+		fmt.Printf("removed user %q\n", args[1])
+		return nil
+
+	case "list":
+		users, err := manager.ListUsers()
+		if err != nil {
+			return fmt.Errorf("failed to list users: %w", err)
+		}
+		for _, u := range users {
+			fmt.Printf("%s\t%s\t%s\n", u.Username, u.Role, u.CreatedAt)
+		}
+		return nil
+
+	case "change-pass":
+		if len(args) != 3 {
+			return fmt.Errorf("usage: pushem user change-pass <username> <new-password>")
+		}
+		if err := manager.ChangePassword(args[1], args[2]); err != nil {
+			return fmt.Errorf("failed to change password: %w", err)
+		}
+		fmt.Printf("updated password for %q\n", args[1])
+		return nil
+
+	case "access":
+		if len(args) != 4 {
+			return fmt.Errorf("usage: pushem user access <username> <topic-pattern> <read|write|read-write>")
+		}
+		perm := auth.Permission(args[3])
+		if perm != auth.PermissionRead && perm != auth.PermissionWrite && perm != auth.PermissionReadWrite {
+			return fmt.Errorf("permission must be one of: read, write, read-write")
+		}
+		token, err := manager.GrantAccess(args[1], args[2], perm, "cli")
+		if err != nil {
+			return fmt.Errorf("failed to grant access: %w", err)
+		}
+		fmt.Printf("token (shown once, store it now): %s\n", token)
+		return nil
+
+	default:
+		return fmt.Errorf("unknown user subcommand %q: usage: pushem user <add|remove|list|change-pass|access> ...", args[0])
+	}
+}
@@ -3,15 +3,22 @@ package api
 import (
 	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"pushem/internal/callback"
 	"pushem/internal/db"
+	"pushem/internal/fcm"
+	"pushem/internal/filecache"
+	"pushem/internal/metrics"
+	"pushem/internal/stream"
 	"pushem/internal/validation"
 	"pushem/internal/webpush"
 
@@ -21,12 +28,38 @@ import (
 )
 
 type Handler struct {
-	db                 *db.DB
-	webpush            *webpush.Service
-	adminPasswordHash  []byte
-	jwtSecret          []byte
-	tokenExpiryMinutes int
-	loginRateLimiter   *LoginRateLimiter
+	db                  *db.DB
+	webpush             *webpush.Service
+	fcm                 *fcm.Service
+	callback            *callback.Service
+	stream              *stream.Hub
+	attachments         filecache.Cache
+	attachmentRetention time.Duration
+	adminPasswordHash   []byte
+	jwtSecret           []byte
+	tokenExpiryMinutes  int
+	loginRateLimiter    *LoginRateLimiter
+
+	// recordOwner, if set, grants whichever user authenticated a
+	// ProtectTopic request ownership of the topic being protected. It's a
+	// func rather than an *auth.Manager field so this package doesn't need
+	// to import auth; main.go wires it to authManager.RecordTopicOwner.
+	recordOwner func(r *http.Request, topic string) error
+
+	// identifyUser resolves the user account (if any) that authenticated
+	// a request, so published messages and subscriptions can be
+	// attributed to it for tier accounting. Like recordOwner, it's a func
+	// rather than an *auth.Manager field; main.go wires it to
+	// authManager.IdentifyUser. It returns (0, false) for requests with
+	// no recognized credential.
+	identifyUser func(r *http.Request) (int64, bool)
+
+	// checkAttachmentQuota, if set, rejects a PUT /publish/{topic}
+	// attachment upload of the given declared size that would exceed the
+	// caller's tier AttachmentFileSizeLimit or AttachmentTotalSizeLimit.
+	// Like identifyUser, it's a func rather than an *auth.Manager field;
+	// main.go wires it to authManager.CheckAttachmentQuota.
+	checkAttachmentQuota func(r *http.Request, size int64) error
 }
 
 // LoginAttempt tracks a single login attempt
@@ -120,14 +153,14 @@ func (l *LoginRateLimiter) ResetAttempts(ip string) {
 	delete(l.attempts, ip)
 }
 
-func NewHandler(database *db.DB, webpushService *webpush.Service, adminPassword string, tokenExpiryMinutes int, maxLoginAttempts int, loginRateLimitWindow int) *Handler {
+func NewHandler(database *db.DB, webpushService *webpush.Service, fcmService *fcm.Service, callbackService *callback.Service, streamHub *stream.Hub, attachments filecache.Cache, attachmentRetention time.Duration, adminPassword string, tokenExpiryMinutes int, maxLoginAttempts int, loginRateLimitWindow int, recordOwner func(r *http.Request, topic string) error, identifyUser func(r *http.Request) (int64, bool), checkAttachmentQuota func(r *http.Request, size int64) error) *Handler {
 	var adminPasswordHash []byte
 
 	// Hash the admin password if provided
 	if adminPassword != "" {
 		hash, err := bcrypt.GenerateFromPassword([]byte(adminPassword), bcrypt.DefaultCost)
 		if err != nil {
-			log.Printf("Warning: Failed to hash admin password: %v", err)
+			slog.Warn("failed to hash admin password", "error", err)
 		} else {
 			adminPasswordHash = hash
 		}
@@ -136,7 +169,7 @@ func NewHandler(database *db.DB, webpushService *webpush.Service, adminPassword
 	// Generate a random JWT secret key
 	jwtSecret := make([]byte, 32)
 	if _, err := rand.Read(jwtSecret); err != nil {
-		log.Printf("Warning: Failed to generate JWT secret: %v", err)
+		slog.Warn("failed to generate JWT secret", "error", err)
 	}
 
 	if tokenExpiryMinutes <= 0 {
@@ -155,15 +188,36 @@ func NewHandler(database *db.DB, webpushService *webpush.Service, adminPassword
 	rateLimiter := NewLoginRateLimiter(maxLoginAttempts, loginRateLimitWindow)
 
 	return &Handler{
-		db:                 database,
-		webpush:            webpushService,
-		adminPasswordHash:  adminPasswordHash,
-		jwtSecret:          jwtSecret,
-		tokenExpiryMinutes: tokenExpiryMinutes,
-		loginRateLimiter:   rateLimiter,
+		db:                   database,
+		webpush:              webpushService,
+		fcm:                  fcmService,
+		callback:             callbackService,
+		stream:               streamHub,
+		attachments:          attachments,
+		attachmentRetention:  attachmentRetention,
+		adminPasswordHash:    adminPasswordHash,
+		jwtSecret:            jwtSecret,
+		tokenExpiryMinutes:   tokenExpiryMinutes,
+		loginRateLimiter:     rateLimiter,
+		recordOwner:          recordOwner,
+		identifyUser:         identifyUser,
+		checkAttachmentQuota: checkAttachmentQuota,
 	}
 }
 
+// callerUserID resolves the user id behind r via h.identifyUser, returning
+// 0 (no identified caller) if identifyUser is unset or finds none.
+func (h *Handler) callerUserID(r *http.Request) int64 {
+	if h.identifyUser == nil {
+		return 0
+	}
+	userID, ok := h.identifyUser(r)
+	if !ok {
+		return 0
+	}
+	return userID
+}
+
 // AdminClaims represents the JWT claims for admin authentication
 type AdminClaims struct {
 	Admin bool `json:"admin"`
@@ -224,10 +278,34 @@ type SubscribeRequest struct {
 	} `json:"keys"`
 }
 
+// FCMSubscribeRequest is the body of POST /subscribe/{topic}/fcm: an FCM
+// registration token in place of the VAPID endpoint/keys triple.
+type FCMSubscribeRequest struct {
+	Token string `json:"token"`
+}
+
+// CallbackSubscribeRequest is the body of POST /subscribe/{topic}/callback:
+// an HTTP callback URL in place of the VAPID endpoint/keys triple or FCM
+// token, plus an optional requested lease duration.
+type CallbackSubscribeRequest struct {
+	CallbackURL  string `json:"callback_url"`
+	LeaseSeconds int    `json:"lease_seconds"`
+}
+
 type ProtectTopicRequest struct {
 	Secret string `json:"secret"`
 }
 
+// endpointHost extracts the push-service host from a subscription endpoint
+// URL, for use in logs without leaking the full per-subscriber path.
+func endpointHost(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
 func (h *Handler) checkAuth(w http.ResponseWriter, r *http.Request, topic string) bool {
 	// Check header first
 	providedKey := r.Header.Get("X-Pushem-Key")
@@ -239,7 +317,7 @@ func (h *Handler) checkAuth(w http.ResponseWriter, r *http.Request, topic string
 	// Verify the secret using bcrypt (includes timing attack protection)
 	isValid, err := h.db.VerifyTopicSecret(topic, providedKey)
 	if err != nil {
-		log.Printf("Failed to verify topic secret: %v", err)
+		slog.Error("failed to verify topic secret", "topic", topic, "error", err)
 		http.Error(w, "internal server error", http.StatusInternalServerError)
 		return false
 	}
@@ -252,53 +330,66 @@ func (h *Handler) checkAuth(w http.ResponseWriter, r *http.Request, topic string
 	return true
 }
 
+// CheckAuth reports whether r is authorized to access topic, writing an
+// error response if not. It is exported so that other subsystems (e.g.
+// internal/stream) can reuse the same topic-protection semantics.
+func (h *Handler) CheckAuth(w http.ResponseWriter, r *http.Request, topic string) bool {
+	return h.checkAuth(w, r, topic)
+}
+
 func (h *Handler) ProtectTopic(w http.ResponseWriter, r *http.Request) {
 	topic := chi.URLParam(r, "topic")
 	if topic == "" {
-		log.Printf("ProtectTopic: topic is empty")
+		slog.Warn("protect topic: topic is empty")
 		http.Error(w, "topic is required", http.StatusBadRequest)
 		return
 	}
 
 	// Validate topic name
 	if err := validation.ValidateTopic(topic); err != nil {
-		log.Printf("ProtectTopic: invalid topic '%s': %v", topic, err)
+		slog.Warn("protect topic: invalid topic", "topic", topic, "error", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	var req ProtectTopicRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		log.Printf("ProtectTopic: failed to decode request body: %v", err)
+		slog.Warn("protect topic: failed to decode request body", "error", err)
 		http.Error(w, "invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	log.Printf("ProtectTopic: topic='%s', secret length=%d (before sanitization)", topic, len(req.Secret))
+	slog.Debug("protect topic: secret received", "topic", topic, "secret_length", len(req.Secret))
 
 	// Sanitize and validate secret
 	req.Secret = validation.SanitizeString(req.Secret)
-	log.Printf("ProtectTopic: secret length=%d (after sanitization)", len(req.Secret))
+	slog.Debug("protect topic: secret sanitized", "secret_length", len(req.Secret))
 
 	if err := validation.ValidateSecret(req.Secret); err != nil {
-		log.Printf("ProtectTopic: secret validation failed for topic '%s': %v", topic, err)
+		slog.Warn("protect topic: secret validation failed", "topic", topic, "error", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	// If already protected, check if authorized to change it
 	if !h.checkAuth(w, r, topic) {
-		log.Printf("ProtectTopic: auth check failed for topic '%s'", topic)
+		slog.Warn("protect topic: auth check failed", "topic", topic)
 		return
 	}
 
 	if err := h.db.ProtectTopic(topic, req.Secret); err != nil {
-		log.Printf("Failed to protect topic '%s': %v", topic, err)
+		slog.Error("failed to protect topic", "topic", topic, "error", err)
 		http.Error(w, "failed to protect topic", http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("Successfully protected topic '%s'", topic)
+	if h.recordOwner != nil {
+		if err := h.recordOwner(r, topic); err != nil {
+			slog.Warn("failed to record topic owner", "topic", topic, "error", err)
+		}
+	}
+
+	slog.Info("topic protected", "topic", topic)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"status": "topic protected"})
 }
@@ -338,19 +429,256 @@ func (h *Handler) Subscribe(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.db.SaveSubscription(topic, req.Endpoint, req.Keys.P256dh, req.Keys.Auth); err != nil {
-		log.Printf("Failed to save subscription: %v", err)
+	if err := h.db.SaveSubscription(topic, req.Endpoint, req.Keys.P256dh, req.Keys.Auth, h.callerUserID(r)); err != nil {
+		slog.Error("failed to save subscription", "topic", topic, "error", err)
+		http.Error(w, "failed to save subscription", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("subscribed to topic", "topic", topic, "endpoint_host", endpointHost(req.Endpoint))
+	metrics.ActiveSubscriptions.Inc()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"status": "subscribed"})
+}
+
+// SubscribeFCM handles POST /subscribe/{topic}/fcm: the FCM counterpart of
+// Subscribe, registering a Firebase registration token instead of a VAPID
+// endpoint/keys triple. Native mobile apps and browsers that can't do raw
+// web push use this route.
+func (h *Handler) SubscribeFCM(w http.ResponseWriter, r *http.Request) {
+	topic := chi.URLParam(r, "topic")
+	if topic == "" {
+		http.Error(w, "topic is required", http.StatusBadRequest)
+		return
+	}
+
+	if err := validation.ValidateTopic(topic); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !h.checkAuth(w, r, topic) {
+		return
+	}
+
+	var req FCMSubscribeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.Token == "" {
+		http.Error(w, "token is required", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.db.SaveFCMSubscription(topic, req.Token, h.callerUserID(r)); err != nil {
+		slog.Error("failed to save fcm subscription", "topic", topic, "error", err)
 		http.Error(w, "failed to save subscription", http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("Subscribed to topic '%s': %s", topic, req.Endpoint)
+	slog.Info("subscribed to topic via fcm", "topic", topic)
+	metrics.ActiveSubscriptions.Inc()
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(map[string]string{"status": "subscribed"})
 }
 
+// Default and bound lease durations for callback subscriptions, following
+// the WebSub spec's recommendation of a renewable, bounded lease rather
+// than an indefinite one.
+const (
+	defaultCallbackLeaseSeconds = 24 * 60 * 60
+	minCallbackLeaseSeconds     = 5 * 60
+	maxCallbackLeaseSeconds     = 7 * 24 * 60 * 60
+)
+
+// SubscribeCallback handles POST /subscribe/{topic}/callback: the
+// WebSub-style counterpart of Subscribe/SubscribeFCM, registering an HTTP
+// callback URL instead of a push service endpoint/token. Before
+// persisting, it runs the WebSub subscribe handshake against the callback
+// URL (h.callback.Verify), so a caller can't register an endpoint it
+// doesn't actually control to receive a topic's messages.
+func (h *Handler) SubscribeCallback(w http.ResponseWriter, r *http.Request) {
+	topic := chi.URLParam(r, "topic")
+	if topic == "" {
+		http.Error(w, "topic is required", http.StatusBadRequest)
+		return
+	}
+
+	if err := validation.ValidateTopic(topic); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !h.checkAuth(w, r, topic) {
+		return
+	}
+
+	if h.callback == nil {
+		http.Error(w, "callback subscriptions are not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	var req CallbackSubscribeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := validation.ValidateURL(req.CallbackURL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	leaseSeconds := req.LeaseSeconds
+	if leaseSeconds <= 0 {
+		leaseSeconds = defaultCallbackLeaseSeconds
+	}
+	if leaseSeconds < minCallbackLeaseSeconds {
+		leaseSeconds = minCallbackLeaseSeconds
+	}
+	if leaseSeconds > maxCallbackLeaseSeconds {
+		leaseSeconds = maxCallbackLeaseSeconds
+	}
+
+	if err := h.callback.Verify(req.CallbackURL, topic); err != nil {
+		slog.Warn("callback verification failed", "topic", topic, "callback_host", endpointHost(req.CallbackURL), "error", err)
+		http.Error(w, "callback verification failed: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	secret, err := callback.GenerateSecret()
+	if err != nil {
+		slog.Error("failed to generate callback secret", "error", err)
+		http.Error(w, "failed to create subscription", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.db.SaveCallbackSubscription(topic, req.CallbackURL, secret, leaseSeconds); err != nil {
+		slog.Error("failed to save callback subscription", "topic", topic, "error", err)
+		http.Error(w, "failed to save subscription", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("subscribed to topic via callback", "topic", topic, "callback_host", endpointHost(req.CallbackURL))
+	metrics.ActiveSubscriptions.Inc()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":        "subscribed",
+		"secret":        secret,
+		"lease_seconds": leaseSeconds,
+	})
+}
+
+// subscriberKey identifies a subscriber for logging: an FCM subscription
+// carries a token rather than an endpoint URL, and a callback subscription's
+// URL is third-party infrastructure rather than a push service, so neither
+// has a push-service host to log.
+func subscriberKey(sub db.Subscription) string {
+	switch sub.Type {
+	case "fcm":
+		return "fcm"
+	case "callback":
+		return "callback"
+	default:
+		return endpointHost(sub.Endpoint)
+	}
+}
+
+// transportFor returns the Transport that delivers to sub, or nil if none
+// is available (an "fcm" subscription when FIREBASE_CREDENTIALS isn't set).
+func (h *Handler) transportFor(sub db.Subscription) webpush.Transport {
+	switch sub.Type {
+	case "fcm":
+		if h.fcm == nil {
+			return nil
+		}
+		return h.fcm
+	case "callback":
+		if h.callback == nil {
+			return nil
+		}
+		return h.callback
+	default:
+		return h.webpush
+	}
+}
+
+// deleteSubscription removes sub from whichever table its type is stored
+// in, for dispatch to call once a transport reports it expired.
+func (h *Handler) deleteSubscription(sub db.Subscription) error {
+	if sub.Type == "callback" {
+		return h.db.DeleteCallbackSubscription(sub.Endpoint)
+	}
+	return h.db.DeleteSubscription(sub.Endpoint)
+}
+
+// dispatch fans payload out to every subscription concurrently, routing
+// each one through the Transport its type calls for (web push/APNs vs.
+// FCM) and deleting any subscription a transport reports as expired. It's
+// shared by Publish and PublishAttachment, which differ only in how the
+// payload was built.
+func (h *Handler) dispatch(topic string, subscriptions []db.Subscription, payload webpush.NotificationPayload) (sent, failed int) {
+	start := time.Now()
+	defer func() { metrics.PublishFanoutDuration.Observe(time.Since(start).Seconds()) }()
+
+	const MaxConcurrentPushes = 10
+	sem := make(chan struct{}, MaxConcurrentPushes)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+
+	for _, sub := range subscriptions {
+		wg.Add(1)
+		go func(s db.Subscription) {
+			defer wg.Done()
+			sem <- struct{}{}        // Acquire semaphore
+			defer func() { <-sem }() // Release semaphore
+
+			transport := h.transportFor(s)
+			if transport == nil {
+				slog.Warn("no transport configured for subscription", "topic", topic, "type", s.Type)
+				mu.Lock()
+				failed++
+				mu.Unlock()
+				return
+			}
+
+			target := webpush.Target{Endpoint: s.Endpoint, P256dh: s.P256dh, Auth: s.Auth, Token: s.Token}
+			err := transport.SendNotification(target, payload)
+			if err != nil {
+				slog.Warn("failed to send notification", "topic", topic, "subscriber", subscriberKey(s), "error", err)
+
+				if errors.Is(err, webpush.ErrSubscriptionExpired) {
+					slog.Info("removing expired subscription", "subscriber", subscriberKey(s))
+					if err := h.deleteSubscription(s); err != nil {
+						slog.Error("failed to delete subscription", "subscriber", subscriberKey(s), "error", err)
+					} else {
+						metrics.ActiveSubscriptions.Dec()
+					}
+				}
+
+				mu.Lock()
+				failed++
+				mu.Unlock()
+			} else {
+				mu.Lock()
+				sent++
+				mu.Unlock()
+			}
+		}(sub)
+	}
+
+	wg.Wait()
+	return sent, failed
+}
+
 func (h *Handler) Publish(w http.ResponseWriter, r *http.Request) {
 	topic := chi.URLParam(r, "topic")
 	if topic == "" {
@@ -403,6 +731,8 @@ func (h *Handler) Publish(w http.ResponseWriter, r *http.Request) {
 		payload.Title = "Notification"
 	}
 
+	applyRichHeaders(&payload, r)
+
 	// Sanitize and validate message content
 	payload.Title = validation.SanitizeString(payload.Title)
 	payload.Message = validation.SanitizeString(payload.Message)
@@ -410,22 +740,42 @@ func (h *Handler) Publish(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if err := validateRichFields(&payload); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	// Save message to history
-	if err := h.db.SaveMessage(topic, payload.Title, payload.Message); err != nil {
-		log.Printf("Failed to save message to history: %v", err)
+	seq, createdAt, err := h.db.SaveMessage(topic, payload.Title, payload.Message, richFieldsFromPayload(payload), h.callerUserID(r))
+	if err != nil {
+		slog.Error("failed to save message to history", "topic", topic, "error", err)
 		// We initiate the publish anyway, even if saving history fails
 	}
+	metrics.MessagesPublishedTotal.WithLabelValues(topic).Inc()
+
+	// Fan out to any live WebSocket/SSE listeners attached to this topic,
+	// publishing the seq/created_at SaveMessage just assigned rather than
+	// re-querying GetMessagesByTopic, whose ORDER BY created_at DESC has
+	// no tiebreak and can't be trusted to return the row just inserted.
+	if h.stream != nil && err == nil {
+		h.stream.Publish(stream.Message{
+			ID:        seq,
+			Topic:     topic,
+			Title:     payload.Title,
+			Message:   payload.Message,
+			CreatedAt: createdAt,
+		})
+	}
 
 	subscriptions, err := h.db.GetSubscriptionsByTopic(topic)
 	if err != nil {
-		log.Printf("Failed to get subscriptions: %v", err)
+		slog.Error("failed to get subscriptions", "topic", topic, "error", err)
 		http.Error(w, "failed to get subscriptions", http.StatusInternalServerError)
 		return
 	}
 
 	if len(subscriptions) == 0 {
-		log.Printf("No subscriptions found for topic '%s'", topic)
+		slog.Info("no subscriptions found for topic", "topic", topic)
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{
 			"status": "published",
@@ -434,56 +784,185 @@ func (h *Handler) Publish(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sent := 0
-	failed := 0
+	sent, failed := h.dispatch(topic, subscriptions, payload)
 
-	// Send notifications concurrently with limited parallelism
-	const MaxConcurrentPushes = 10
-	sem := make(chan struct{}, MaxConcurrentPushes)
-	var wg sync.WaitGroup
-	var mu sync.Mutex
+	slog.Info("published to topic", "topic", topic, "sent", sent, "failed", failed)
 
-	for _, sub := range subscriptions {
-		wg.Add(1)
-		go func(s db.Subscription) {
-			defer wg.Done()
-			sem <- struct{}{}        // Acquire semaphore
-			defer func() { <-sem }() // Release semaphore
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "published",
+		"sent":   sent,
+		"failed": failed,
+	})
+}
 
-			err := h.webpush.SendNotification(s.Endpoint, s.P256dh, s.Auth, payload)
-			if err != nil {
-				log.Printf("Failed to send notification to %s: %v", s.Endpoint, err)
+// requestScheme returns "https" or "http" for building absolute URLs back
+// to this server, honoring a reverse proxy's X-Forwarded-Proto when present.
+func requestScheme(r *http.Request) string {
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		return proto
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
 
-				if strings.Contains(err.Error(), "410 Gone") {
-					log.Printf("Removing expired subscription: %s", s.Endpoint)
-					if err := h.db.DeleteSubscription(s.Endpoint); err != nil {
-						log.Printf("Failed to delete subscription: %v", err)
-					}
-				}
+// PublishAttachment handles PUT /publish/{topic}: it stores the request
+// body as a file attachment and publishes a notification carrying a link
+// to it, fanning out to subscribers the same way Publish does.
+func (h *Handler) PublishAttachment(w http.ResponseWriter, r *http.Request) {
+	topic := chi.URLParam(r, "topic")
+	if topic == "" {
+		http.Error(w, "topic is required", http.StatusBadRequest)
+		return
+	}
 
-				mu.Lock()
-				failed++
-				mu.Unlock()
-			} else {
-				mu.Lock()
-				sent++
-				mu.Unlock()
-			}
-		}(sub)
+	if err := validation.ValidateTopic(topic); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	wg.Wait()
+	if !h.checkAuth(w, r, topic) {
+		return
+	}
 
-	log.Printf("Published to topic '%s': sent=%d, failed=%d", topic, sent, failed)
+	if h.attachments == nil {
+		http.Error(w, "attachments are not configured on this server", http.StatusServiceUnavailable)
+		return
+	}
+
+	filename := validation.SanitizeString(r.Header.Get("Filename"))
+	contentType := r.Header.Get("Content-Type")
+
+	if err := validation.ValidateAttachment(filename, contentType, r.ContentLength); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, validation.MaxAttachmentSize)
+
+	title := validation.SanitizeString(r.Header.Get("X-Pushem-Title"))
+	message := validation.SanitizeString(r.Header.Get("X-Pushem-Message"))
+	if title == "" {
+		title = "Notification"
+	}
+	if message == "" {
+		message = filename
+	}
+	if err := validation.ValidateMessage(title, message); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if h.checkAttachmentQuota != nil {
+		if err := h.checkAttachmentQuota(r, r.ContentLength); err != nil {
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	expiresAt := time.Now().Add(h.attachmentRetention)
+	attachment, err := h.attachments.Put(r.Context(), filename, contentType, expiresAt, r.Body)
+	if err != nil {
+		if err.Error() == "http: request body too large" {
+			http.Error(w, "attachment too large (max 100 MB)", http.StatusRequestEntityTooLarge)
+			return
+		}
+		slog.Error("failed to store attachment", "topic", topic, "error", err)
+		http.Error(w, "failed to store attachment", http.StatusInternalServerError)
+		return
+	}
+
+	payload := webpush.NotificationPayload{
+		Title:          title,
+		Message:        message,
+		AttachmentURL:  requestScheme(r) + "://" + r.Host + "/file/" + attachment.ID,
+		AttachmentName: attachment.Name,
+		AttachmentSize: attachment.Size,
+		AttachmentType: attachment.ContentType,
+	}
+	applyRichHeaders(&payload, r)
+	if err := validateRichFields(&payload); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	seq, createdAt, err := h.db.SaveMessageWithAttachment(topic, payload.Title, payload.Message, richFieldsFromPayload(payload), attachment.ID, attachment.Name, attachment.ContentType, attachment.Size, h.callerUserID(r), expiresAt, getClientIP(r))
+	if err != nil {
+		slog.Error("failed to save message to history", "topic", topic, "error", err)
+		// We initiate the publish anyway, even if saving history fails
+	}
+	metrics.MessagesPublishedTotal.WithLabelValues(topic).Inc()
+
+	if h.stream != nil && err == nil {
+		h.stream.Publish(stream.Message{
+			ID:        seq,
+			Topic:     topic,
+			Title:     payload.Title,
+			Message:   payload.Message,
+			CreatedAt: createdAt,
+		})
+	}
+
+	subscriptions, err := h.db.GetSubscriptionsByTopic(topic)
+	if err != nil {
+		slog.Error("failed to get subscriptions", "topic", topic, "error", err)
+		http.Error(w, "failed to get subscriptions", http.StatusInternalServerError)
+		return
+	}
+
+	if len(subscriptions) == 0 {
+		slog.Info("no subscriptions found for topic", "topic", topic)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":         "published",
+			"sent":           0,
+			"attachment_url": payload.AttachmentURL,
+		})
+		return
+	}
+
+	sent, failed := h.dispatch(topic, subscriptions, payload)
+
+	slog.Info("published attachment to topic", "topic", topic, "sent", sent, "failed", failed)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"status": "published",
-		"sent":   sent,
-		"failed": failed,
+		"status":         "published",
+		"sent":           sent,
+		"failed":         failed,
+		"attachment_url": payload.AttachmentURL,
 	})
 }
 
+// GetAttachment handles GET /file/{id}, streaming a previously published
+// attachment back to the caller.
+func (h *Handler) GetAttachment(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	if id == "" {
+		http.Error(w, "attachment id is required", http.StatusBadRequest)
+		return
+	}
+
+	if h.attachments == nil {
+		http.Error(w, "attachments are not configured on this server", http.StatusServiceUnavailable)
+		return
+	}
+
+	body, attachment, err := h.attachments.Open(r.Context(), id)
+	if err != nil {
+		http.Error(w, "attachment not found", http.StatusNotFound)
+		return
+	}
+	defer body.Close()
+
+	w.Header().Set("Content-Type", attachment.ContentType)
+	w.Header().Set("Content-Disposition", "inline; filename=\""+attachment.Name+"\"")
+	w.Header().Set("Content-Length", strconv.FormatInt(attachment.Size, 10))
+	io.Copy(w, body)
+}
+
 func (h *Handler) GetHistory(w http.ResponseWriter, r *http.Request) {
 	topic := chi.URLParam(r, "topic")
 	if topic == "" {
@@ -504,7 +983,7 @@ func (h *Handler) GetHistory(w http.ResponseWriter, r *http.Request) {
 
 	messages, err := h.db.GetMessagesByTopic(topic)
 	if err != nil {
-		log.Printf("Failed to get messages: %v", err)
+		slog.Error("failed to get messages", "topic", topic, "error", err)
 		http.Error(w, "failed to get messages", http.StatusInternalServerError)
 		return
 	}
@@ -532,7 +1011,7 @@ func (h *Handler) ClearHistory(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := h.db.ClearMessages(topic); err != nil {
-		log.Printf("Failed to clear messages: %v", err)
+		slog.Error("failed to clear messages", "topic", topic, "error", err)
 		http.Error(w, "failed to clear messages", http.StatusInternalServerError)
 		return
 	}
@@ -560,12 +1039,7 @@ func (h *Handler) DeleteMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Parse message ID
-	messageID, err := strconv.Atoi(messageIDStr)
-	if err != nil {
-		http.Error(w, "invalid message ID", http.StatusBadRequest)
-		return
-	}
+	messageID := messageIDStr
 
 	// Authorization check
 	if !h.checkAuth(w, r, topic) {
@@ -574,7 +1048,7 @@ func (h *Handler) DeleteMessage(w http.ResponseWriter, r *http.Request) {
 
 	// Delete the message
 	if err := h.db.DeleteMessage(topic, messageID); err != nil {
-		log.Printf("Failed to delete message %d from topic '%s': %v", messageID, topic, err)
+		slog.Error("failed to delete message", "message_id", messageID, "topic", topic, "error", err)
 
 		// Return appropriate status code based on error
 		if err.Error() == "message not found" || err.Error() == "message does not belong to topic" {
@@ -585,7 +1059,7 @@ func (h *Handler) DeleteMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("Deleted message %d from topic '%s'", messageID, topic)
+	slog.Info("deleted message", "message_id", messageID, "topic", topic)
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"status": "message deleted"})
 }
@@ -629,7 +1103,7 @@ func (h *Handler) RequireAdmin(next http.Handler) http.Handler {
 func (h *Handler) AdminListTopics(w http.ResponseWriter, r *http.Request) {
 	topics, err := h.db.ListAllTopics()
 	if err != nil {
-		log.Printf("Failed to list topics: %v", err)
+		slog.Error("failed to list topics", "error", err)
 		http.Error(w, "failed to list topics", http.StatusInternalServerError)
 		return
 	}
@@ -647,12 +1121,12 @@ func (h *Handler) AdminDeleteTopic(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := h.db.DeleteTopic(topic); err != nil {
-		log.Printf("Failed to delete topic: %v", err)
+		slog.Error("failed to delete topic", "topic", topic, "error", err)
 		http.Error(w, "failed to delete topic", http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("Admin: Deleted topic '%s'", topic)
+	slog.Info("admin deleted topic", "topic", topic)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"status": "topic deleted"})
 }
@@ -666,12 +1140,12 @@ func (h *Handler) AdminUnprotectTopic(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := h.db.UnprotectTopic(topic); err != nil {
-		log.Printf("Failed to unprotect topic: %v", err)
+		slog.Error("failed to unprotect topic", "topic", topic, "error", err)
 		http.Error(w, "failed to unprotect topic", http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("Admin: Unprotected topic '%s'", topic)
+	slog.Info("admin unprotected topic", "topic", topic)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"status": "topic unprotected"})
 }
@@ -689,7 +1163,8 @@ func (h *Handler) AdminLogin(w http.ResponseWriter, r *http.Request) {
 
 	// Check rate limiting
 	if !h.loginRateLimiter.IsAllowed(clientIP) {
-		log.Printf("Admin login rate limit exceeded for IP: %s", clientIP)
+		slog.Warn("admin login rate limit exceeded", "client_ip", clientIP)
+		metrics.AdminLoginTotal.WithLabelValues("rate_limited").Inc()
 		http.Error(w, "too many failed login attempts, please try again later", http.StatusTooManyRequests)
 		return
 	}
@@ -709,7 +1184,8 @@ func (h *Handler) AdminLogin(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		// Password doesn't match - record failed attempt
 		h.loginRateLimiter.RecordFailedAttempt(clientIP)
-		log.Printf("Admin login attempt with incorrect password from IP: %s", clientIP)
+		slog.Warn("admin login attempt with incorrect password", "client_ip", clientIP)
+		metrics.AdminLoginTotal.WithLabelValues("failure").Inc()
 		http.Error(w, "invalid password", http.StatusUnauthorized)
 		return
 	}
@@ -717,21 +1193,22 @@ func (h *Handler) AdminLogin(w http.ResponseWriter, r *http.Request) {
 	// Generate JWT token
 	token, err := h.generateAdminToken()
 	if err != nil {
-		log.Printf("Failed to generate admin token: %v", err)
+		slog.Error("failed to generate admin token", "error", err)
 		http.Error(w, "failed to generate token", http.StatusInternalServerError)
 		return
 	}
 
 	// Successful login - reset rate limit for this IP
 	h.loginRateLimiter.ResetAttempts(clientIP)
-	log.Printf("Admin login successful from IP: %s", clientIP)
+	slog.Info("admin login successful", "client_ip", clientIP)
+	metrics.AdminLoginTotal.WithLabelValues("success").Inc()
 
 	// Return token and expiry info
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"token":       token,
-		"expires_in":  h.tokenExpiryMinutes * 60, // Return seconds
-		"token_type":  "Bearer",
+		"token":      token,
+		"expires_in": h.tokenExpiryMinutes * 60, // Return seconds
+		"token_type": "Bearer",
 	})
 }
 
@@ -0,0 +1,149 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"pushem/internal/db"
+	"pushem/internal/validation"
+	"pushem/internal/webpush"
+)
+
+// priorityNames maps ntfy's named priority levels onto the 1-5 scale, so
+// `curl -H "Priority: high"` works the same as `-H "Priority: 4"`.
+var priorityNames = map[string]int{
+	"min":     1,
+	"low":     2,
+	"default": 3,
+	"high":    4,
+	"max":     5,
+	"urgent":  5,
+}
+
+// headerValue returns the first non-empty header among names, so a short
+// alias (e.g. "Tags") can stand in for the canonical "X-Tags" header.
+func headerValue(r *http.Request, names ...string) string {
+	for _, name := range names {
+		if v := r.Header.Get(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// parsePriority parses a priority as either a named level (min/low/
+// default/high/max) or a literal 1-5 integer.
+func parsePriority(raw string) (int, bool) {
+	raw = strings.ToLower(strings.TrimSpace(raw))
+	if raw == "" {
+		return 0, false
+	}
+	if n, ok := priorityNames[raw]; ok {
+		return n, true
+	}
+	if n, err := strconv.Atoi(raw); err == nil {
+		return n, true
+	}
+	return 0, false
+}
+
+// parseActionsHeader parses the X-Actions header, a semicolon-separated
+// list of "action,title,url" triplets (e.g. "view,Open,https://example.com;
+// dismiss,Dismiss,").
+func parseActionsHeader(raw string) []webpush.Action {
+	if raw == "" {
+		return nil
+	}
+
+	var actions []webpush.Action
+	for _, entry := range strings.Split(raw, ";") {
+		parts := strings.SplitN(entry, ",", 3)
+		if len(parts) < 2 {
+			continue
+		}
+		action := webpush.Action{
+			Action: strings.TrimSpace(parts[0]),
+			Title:  strings.TrimSpace(parts[1]),
+		}
+		if len(parts) == 3 {
+			action.URL = strings.TrimSpace(parts[2])
+		}
+		if action.Action != "" && action.Title != "" {
+			actions = append(actions, action)
+		}
+	}
+	return actions
+}
+
+// applyRichHeaders fills in payload fields the JSON body left unset from
+// the ntfy-style X-<Field> headers (and their short aliases), so shell
+// users can `curl -H "Tags: warning,skull" -d "text"`.
+func applyRichHeaders(payload *webpush.NotificationPayload, r *http.Request) {
+	if payload.Priority == 0 {
+		if raw := headerValue(r, "X-Priority", "Priority"); raw != "" {
+			if n, ok := parsePriority(raw); ok {
+				payload.Priority = n
+			}
+		}
+	}
+	if len(payload.Tags) == 0 {
+		if raw := headerValue(r, "X-Tags", "Tags"); raw != "" {
+			for _, tag := range strings.Split(raw, ",") {
+				if tag = strings.TrimSpace(tag); tag != "" {
+					payload.Tags = append(payload.Tags, tag)
+				}
+			}
+		}
+	}
+	if payload.ClickURL == "" {
+		payload.ClickURL = headerValue(r, "X-Click", "Click")
+	}
+	if payload.Icon == "" {
+		payload.Icon = headerValue(r, "X-Icon", "Icon")
+	}
+	if len(payload.Actions) == 0 {
+		payload.Actions = parseActionsHeader(headerValue(r, "X-Actions", "Actions"))
+	}
+}
+
+// validateRichFields checks and normalizes the optional rich fields of
+// payload, defaulting an unset priority to 3 ("default").
+func validateRichFields(payload *webpush.NotificationPayload) error {
+	if payload.Priority == 0 {
+		payload.Priority = 3
+	}
+	if err := validation.ValidatePriority(payload.Priority); err != nil {
+		return err
+	}
+	if payload.ClickURL != "" {
+		if err := validation.ValidateURL(payload.ClickURL); err != nil {
+			return err
+		}
+	}
+	if payload.Icon != "" {
+		if err := validation.ValidateURL(payload.Icon); err != nil {
+			return err
+		}
+	}
+	for i := range payload.Tags {
+		payload.Tags[i] = validation.SanitizeString(payload.Tags[i])
+	}
+	return nil
+}
+
+// richFieldsFromPayload converts the wire-level payload into the
+// db.RichFields shape persisted alongside a message.
+func richFieldsFromPayload(payload webpush.NotificationPayload) db.RichFields {
+	actions := make([]db.MessageAction, len(payload.Actions))
+	for i, a := range payload.Actions {
+		actions[i] = db.MessageAction{Action: a.Action, Title: a.Title, URL: a.URL}
+	}
+	return db.RichFields{
+		Priority: payload.Priority,
+		Tags:     payload.Tags,
+		Click:    payload.ClickURL,
+		Icon:     payload.Icon,
+		Actions:  actions,
+	}
+}
@@ -0,0 +1,304 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"pushem/internal/db"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// identifyUser resolves the user account behind whatever credential r
+// carries (bearer token, account JWT, or HTTP Basic auth), returning
+// (nil, nil) for a request that carries none of those - the legacy
+// topic-secret path RequirePermission still lets through under
+// PolicyOpen, which has no account to attribute a tier to.
+func (m *Manager) identifyUser(r *http.Request) (*db.User, error) {
+	cred := extractCredential(r)
+	if cred.empty() {
+		return nil, nil
+	}
+
+	switch {
+	case cred.basicUser != "":
+		return m.db.GetUserByUsername(cred.basicUser)
+	case strings.HasPrefix(cred.bearerToken, "tk_"):
+		if len(cred.bearerToken) < tokenPrefixLen {
+			return nil, nil
+		}
+		tok, err := m.db.AuthenticateToken(cred.bearerToken[:tokenPrefixLen], cred.bearerToken, m.tokenExtension, m.maxTokensPerUser)
+		if err != nil || tok == nil {
+			return nil, nil
+		}
+		return m.db.GetUserByID(tok.UserID)
+	default:
+		claims := m.validateAccountToken(cred.bearerToken)
+		if claims == nil {
+			return nil, nil
+		}
+		return m.db.GetUserByUsername(claims.Sub)
+	}
+}
+
+// IdentifyUser resolves the user id behind r, for api.Handler to attribute
+// a published message or subscription to, so tier usage counters and
+// per-user message expiry can account for it. It swallows lookup errors
+// as "no identified caller" rather than surfacing them, same as
+// IsAdminRequest, since callers only use this to attribute ownership, not
+// to gate access.
+func (m *Manager) IdentifyUser(r *http.Request) (int64, bool) {
+	user, err := m.identifyUser(r)
+	if err != nil || user == nil {
+		return 0, false
+	}
+	return user.ID, true
+}
+
+// tierLimited reports whether used has reached limit, writing a 429 and
+// returning true if so. A limit of 0 means unlimited for that dimension.
+func tierLimited(w http.ResponseWriter, used int, retryAfter time.Duration, limit int, message string) bool {
+	if limit <= 0 || used < limit {
+		return false
+	}
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", int(retryAfter.Seconds())))
+	http.Error(w, message, http.StatusTooManyRequests)
+	return true
+}
+
+// tierFor resolves the tier assigned to the user behind r, returning nil
+// if the request carries no identifiable user or the user has no tier
+// assigned - either case leaves the caller subject to no tier-based limit
+// at all (only the IP-based visitor limits still apply).
+func (m *Manager) tierFor(r *http.Request) (*db.User, *db.Tier, error) {
+	user, err := m.identifyUser(r)
+	if err != nil || user == nil || user.TierID == "" {
+		return user, nil, err
+	}
+	tier, err := m.db.GetTierByID(user.TierID)
+	return user, tier, err
+}
+
+// EnforcePublishTier is chi middleware around POST/PUT /publish/{topic}
+// that rejects a publish once the caller's tier MessagesLimit or
+// PublishRatePerHour is exhausted. It runs after RequirePermission, so by
+// the time it executes the caller (if any) is already known to hold
+// write access to the topic.
+func (m *Manager) EnforcePublishTier(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, tier, err := m.tierFor(r)
+		if err != nil || tier == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if used, err := m.db.MessagesUsedByUser(user.ID); err == nil {
+			if tierLimited(w, used, time.Hour, tier.MessagesLimit, "tier message limit reached") {
+				return
+			}
+		}
+
+		if used, err := m.db.MessagesPublishedSince(user.ID, time.Hour); err == nil {
+			if tierLimited(w, used, time.Hour, tier.PublishRatePerHour, "tier publish rate exceeded") {
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// EnforceSubscribeTier is chi middleware around POST /subscribe/{topic}
+// that rejects a subscription once the caller's tier SubscriptionsLimit
+// is exhausted.
+func (m *Manager) EnforceSubscribeTier(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, tier, err := m.tierFor(r)
+		if err != nil || tier == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if used, err := m.db.SubscriptionsUsedByUser(user.ID); err == nil {
+			if tierLimited(w, used, time.Hour, tier.SubscriptionsLimit, "tier subscription limit reached") {
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP extracts the caller's address for CheckAttachmentQuota to key
+// an unidentified sender's usage by, honoring X-Forwarded-For the same
+// way api.getClientIP does when PublishAttachment records a message's
+// sender_ip, so both sides agree on the key.
+func clientIP(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		if ip, _, ok := strings.Cut(forwarded, ","); ok {
+			return strings.TrimSpace(ip)
+		}
+		return strings.TrimSpace(forwarded)
+	}
+	if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+		return realIP
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// defaultTierCode is the tier CheckAttachmentQuota falls back to for a
+// caller with no identified account (or an identified one with no tier
+// assigned), so an operator can still cap how much anonymous attachment
+// traffic one IP can hold outstanding. It's an ordinary tier otherwise -
+// nothing requires an operator to define it, and requests are subject to
+// no attachment-total limit at all until they do.
+const defaultTierCode = "default"
+
+// CheckAttachmentQuota rejects an attachment upload of size bytes that
+// would exceed the relevant tier's AttachmentFileSizeLimit or
+// AttachmentTotalSizeLimit: the caller's own tier if they're an
+// identified user with one assigned, or the defaultTierCode tier
+// otherwise. Usage is tracked by user id for an identified user and by
+// IP for an anonymous caller.
+func (m *Manager) CheckAttachmentQuota(r *http.Request, size int64) error {
+	user, tier, err := m.tierFor(r)
+	if err != nil {
+		return nil
+	}
+
+	usedBy := func() (int64, error) {
+		if user != nil {
+			return m.db.AttachmentBytesUsedByUser(user.ID)
+		}
+		return m.db.AttachmentBytesUsedBySender(clientIP(r))
+	}
+
+	if tier == nil {
+		tier, err = m.db.GetTierByCode(defaultTierCode)
+		if err != nil || tier == nil {
+			return nil
+		}
+	}
+
+	if tier.AttachmentFileSizeLimit > 0 && size > tier.AttachmentFileSizeLimit {
+		return fmt.Errorf("attachment exceeds this tier's per-file size limit")
+	}
+
+	if tier.AttachmentTotalSizeLimit <= 0 {
+		return nil
+	}
+
+	used, err := usedBy()
+	if err != nil {
+		return nil
+	}
+
+	if used+size > tier.AttachmentTotalSizeLimit {
+		return fmt.Errorf("attachment would exceed this tier's total attachment storage limit")
+	}
+
+	return nil
+}
+
+// AssignTierByCode assigns username the tier identified by code, or
+// clears its tier assignment entirely when code is "".
+func (m *Manager) AssignTierByCode(username, code string) error {
+	user, err := m.db.GetUserByUsername(username)
+	if err != nil {
+		return fmt.Errorf("failed to look up user: %w", err)
+	}
+	if user == nil {
+		return fmt.Errorf("no such user %q", username)
+	}
+
+	if code == "" {
+		return m.db.AssignTier(user.ID, "")
+	}
+
+	tier, err := m.db.GetTierByCode(code)
+	if err != nil {
+		return fmt.Errorf("failed to look up tier: %w", err)
+	}
+	if tier == nil {
+		return fmt.Errorf("no such tier %q", code)
+	}
+
+	return m.db.AssignTier(user.ID, tier.ID)
+}
+
+// ServeListTiers handles GET /api/admin/tiers, listing every defined
+// tier for an operator choosing which to assign.
+func (m *Manager) ServeListTiers(w http.ResponseWriter, r *http.Request) {
+	tiers, err := m.db.ListTiers()
+	if err != nil {
+		http.Error(w, "failed to list tiers", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tiers)
+}
+
+// ServeCreateTier handles POST /api/admin/tiers, defining a new tier.
+func (m *Manager) ServeCreateTier(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Code                     string `json:"code"`
+		Name                     string `json:"name"`
+		MessagesLimit            int    `json:"messages_limit"`
+		MessagesExpiryDays       int    `json:"messages_expiry_days"`
+		SubscriptionsLimit       int    `json:"subscriptions_limit"`
+		PublishRatePerHour       int    `json:"publish_rate_per_hour"`
+		AttachmentFileSizeLimit  int64  `json:"attachment_file_size_limit"`
+		AttachmentTotalSizeLimit int64  `json:"attachment_total_size_limit"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Code == "" || req.Name == "" {
+		http.Error(w, "code and name are required", http.StatusBadRequest)
+		return
+	}
+
+	id, err := m.db.CreateTier(req.Code, req.Name, req.MessagesLimit, req.MessagesExpiryDays, req.SubscriptionsLimit, req.PublishRatePerHour, req.AttachmentFileSizeLimit, req.AttachmentTotalSizeLimit)
+	if err != nil {
+		http.Error(w, "failed to create tier", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"id": id})
+}
+
+// ServeAssignTier handles POST /api/admin/users/{username}/tier, setting
+// (or, with an empty code, clearing) the tier assigned to username.
+func (m *Manager) ServeAssignTier(w http.ResponseWriter, r *http.Request) {
+	username := chi.URLParam(r, "username")
+	if username == "" {
+		http.Error(w, "username is required", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := m.AssignTierByCode(username, req.Code); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"status": "tier assigned"})
+}
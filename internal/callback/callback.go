@@ -0,0 +1,192 @@
+// Package callback delivers notifications to WebSub-style subscribers
+// registered via POST /subscribe/{topic}/callback, as an alternative to
+// the browser-oriented transports internal/webpush and internal/fcm
+// speak. It implements webpush.Transport so Handler.Publish can dispatch
+// to it the same way it dispatches to VAPID/FCM subscribers, just keyed
+// off a different subscription type, and it owns the subscribe-time
+// verification handshake those two transports don't need.
+package callback
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"pushem/internal/metrics"
+	"pushem/internal/validation"
+	"pushem/internal/webpush"
+)
+
+// challengeTimeout bounds how long the verification handshake's GET
+// request waits for the callback to respond.
+const challengeTimeout = 10 * time.Second
+
+// Service delivers notifications by POSTing a signed JSON payload to a
+// subscriber's callback URL, and performs the WebSub subscribe handshake
+// that confirms a callback URL before it's persisted.
+type Service struct {
+	client *http.Client
+}
+
+// NewService builds a Service whose outbound requests are re-validated
+// against validation.IsBlockedAddr at dial time, the same defense in
+// depth webpush.AppleTransport applies, since callback URLs are
+// third-party infrastructure supplied by the subscriber.
+func NewService() *Service {
+	return &Service{
+		client: &http.Client{
+			Transport: &http.Transport{DialContext: safeDialContext},
+			Timeout:   challengeTimeout,
+		},
+	}
+}
+
+// safeDialContext re-resolves addr and refuses to connect to any address
+// validation.IsBlockedAddr flags, guarding against DNS rebinding between
+// the time validation.ValidateURL approved a callback URL and the time we
+// actually send to it.
+func safeDialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", host, err)
+	}
+
+	var dialer net.Dialer
+	var lastErr error
+	for _, ip := range addrs {
+		if validation.IsBlockedAddr(ip) {
+			continue
+		}
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return nil, fmt.Errorf("no public address found for %s", host)
+}
+
+// GenerateSecret returns a random hex-encoded HMAC key for a new callback
+// subscription, for SubscribeCallback to hand back to the subscriber
+// alongside its 201 response so it can verify X-Pushem-Signature itself.
+func GenerateSecret() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate secret: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// Verify performs the WebSub subscribe handshake against callbackURL: it
+// GETs the URL with hub.mode=subscribe, hub.topic=topic, and a random
+// hub.challenge, and requires the challenge to come back verbatim in the
+// response body before the subscription is considered confirmed.
+func (s *Service) Verify(callbackURL, topic string) error {
+	challenge, err := randomChallenge()
+	if err != nil {
+		return err
+	}
+
+	u, err := url.Parse(callbackURL)
+	if err != nil {
+		return fmt.Errorf("invalid callback url: %w", err)
+	}
+	q := u.Query()
+	q.Set("hub.mode", "subscribe")
+	q.Set("hub.topic", topic)
+	q.Set("hub.challenge", challenge)
+	u.RawQuery = q.Encode()
+
+	resp, err := s.client.Get(u.String())
+	if err != nil {
+		return fmt.Errorf("callback verification request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("callback verification returned status: %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return fmt.Errorf("failed to read callback verification response: %w", err)
+	}
+
+	if strings.TrimSpace(string(body)) != challenge {
+		return fmt.Errorf("callback did not echo the verification challenge")
+	}
+
+	return nil
+}
+
+func randomChallenge() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate challenge: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// SendNotification implements webpush.Transport, POSTing payload as JSON
+// to target.Endpoint (the callback URL) with an HMAC-SHA256 signature
+// over the body, keyed by target.Auth (the subscription's secret), in the
+// X-Pushem-Signature header.
+func (s *Service) SendNotification(target webpush.Target, payload webpush.NotificationPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	mac := hmac.New(sha256.New, []byte(target.Auth))
+	mac.Write(body)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	req, err := http.NewRequest(http.MethodPost, target.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to build callback request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Pushem-Signature", signature)
+
+	start := time.Now()
+	resp, err := s.client.Do(req)
+	metrics.PushSendDuration.WithLabelValues("callback").Observe(time.Since(start).Seconds())
+	if err != nil {
+		metrics.PushSendTotal.WithLabelValues("callback", "error").Inc()
+		return fmt.Errorf("failed to send callback notification: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 410 {
+		metrics.PushSendTotal.WithLabelValues("callback", "expired").Inc()
+		return fmt.Errorf("%w (410 Gone)", webpush.ErrSubscriptionExpired)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		metrics.PushSendTotal.WithLabelValues("callback", "error").Inc()
+		return fmt.Errorf("callback endpoint returned status: %d", resp.StatusCode)
+	}
+
+	metrics.PushSendTotal.WithLabelValues("callback", "success").Inc()
+	return nil
+}
@@ -2,22 +2,54 @@ package db
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
+	"time"
+
+	"pushem/internal/util"
 
 	_ "github.com/mattn/go-sqlite3"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// sqliteTimeLayout matches the format SQLite's CURRENT_TIMESTAMP writes
+// into datetime columns, so expiry math can be done in Go.
+const sqliteTimeLayout = "2006-01-02 15:04:05"
+
+// idByteLength is how many random bytes back a prefixed text id (16 hex
+// characters), matching the length CreateTier already used for "ti_" ids.
+const idByteLength = 8
+
 type DB struct {
 	conn *sql.DB
+
+	// Prepared once here rather than parsed on every call, since these
+	// back the hot publish/subscribe path: a publish does one
+	// insertMessage/insertMessageWithAttachment and one
+	// selectSubscriptionsByTopic per request, and a subscribe does one
+	// insertSubscription or insertFCMSubscription.
+	insertMessage               *sql.Stmt
+	insertMessageWithAttachment *sql.Stmt
+	selectSubscriptionsByTopic  *sql.Stmt
+	insertSubscription          *sql.Stmt
+	insertFCMSubscription       *sql.Stmt
 }
 
 type Subscription struct {
-	ID       int
+	ID       string
 	Topic    string
 	Endpoint string
 	P256dh   string
 	Auth     string
+
+	// Type is "webpush" (the default, delivered via Endpoint/P256dh/Auth),
+	// "fcm" (delivered via Token, an FCM registration token), or
+	// "callback" (delivered via Endpoint as a callback URL, Auth as its
+	// HMAC secret).
+	Type  string
+	Token string
 }
 
 func New(dbPath string) (*DB, error) {
@@ -35,37 +67,443 @@ func New(dbPath string) (*DB, error) {
 		return nil, fmt.Errorf("failed to migrate database: %w", err)
 	}
 
+	if err := db.ensureSchemaUpgrades(); err != nil {
+		return nil, fmt.Errorf("failed to apply schema upgrades: %w", err)
+	}
+
+	if err := db.migrateLegacyIntegerIDs(); err != nil {
+		return nil, fmt.Errorf("failed to migrate legacy integer ids: %w", err)
+	}
+
+	if err := db.prepareStatements(); err != nil {
+		return nil, fmt.Errorf("failed to prepare statements: %w", err)
+	}
+
 	return db, nil
 }
 
+// prepareStatements parses the hot-path queries once so every publish and
+// subscribe request reuses the same *sql.Stmt instead of having SQLite
+// re-parse the query text on every call.
+func (db *DB) prepareStatements() error {
+	var err error
+
+	db.insertMessage, err = db.conn.Prepare(`
+	INSERT INTO messages (id, topic, title, message, priority, tags, click, icon, actions, user_id, created_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare insertMessage: %w", err)
+	}
+
+	db.insertMessageWithAttachment, err = db.conn.Prepare(`
+	INSERT INTO messages (id, topic, title, message, priority, tags, click, icon, actions, attachment_id, attachment_name, attachment_type, attachment_size, attachment_expires, sender_ip, user_id, created_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare insertMessageWithAttachment: %w", err)
+	}
+
+	db.selectSubscriptionsByTopic, err = db.conn.Prepare(
+		`SELECT id, topic, endpoint, p256dh, auth, type, token FROM subscriptions WHERE topic = ?`,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to prepare selectSubscriptionsByTopic: %w", err)
+	}
+
+	db.insertSubscription, err = db.conn.Prepare(`
+	INSERT INTO subscriptions (id, topic, endpoint, p256dh, auth, user_id)
+	VALUES (?, ?, ?, ?, ?, ?)
+	ON CONFLICT(topic, endpoint) DO UPDATE SET
+		p256dh = excluded.p256dh,
+		auth = excluded.auth,
+		user_id = excluded.user_id
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare insertSubscription: %w", err)
+	}
+
+	db.insertFCMSubscription, err = db.conn.Prepare(`
+	INSERT INTO subscriptions (id, topic, endpoint, p256dh, auth, type, token, user_id)
+	VALUES (?, ?, ?, '', '', 'fcm', ?, ?)
+	ON CONFLICT(topic, endpoint) DO UPDATE SET
+		token = excluded.token,
+		user_id = excluded.user_id
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare insertFCMSubscription: %w", err)
+	}
+
+	return nil
+}
+
 func (db *DB) migrate() error {
 	query := `
 	CREATE TABLE IF NOT EXISTS subscriptions (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		id TEXT PRIMARY KEY,
 		topic TEXT NOT NULL,
 		endpoint TEXT NOT NULL,
 		p256dh TEXT NOT NULL,
 		auth TEXT NOT NULL,
+		type TEXT NOT NULL DEFAULT 'webpush',
+		token TEXT NOT NULL DEFAULT '',
+		user_id INTEGER REFERENCES users(id),
 		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 		UNIQUE(topic, endpoint)
 	);
 	CREATE TABLE IF NOT EXISTS messages (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		id TEXT UNIQUE NOT NULL,
 		topic TEXT NOT NULL,
 		title TEXT NOT NULL,
 		message TEXT NOT NULL,
+		priority INTEGER NOT NULL DEFAULT 3,
+		tags TEXT NOT NULL DEFAULT '',
+		click TEXT NOT NULL DEFAULT '',
+		icon TEXT NOT NULL DEFAULT '',
+		actions TEXT NOT NULL DEFAULT '',
+		attachment_id TEXT,
+		attachment_name TEXT,
+		attachment_type TEXT,
+		attachment_size INTEGER,
+		attachment_expires DATETIME,
+		attachment_deleted INTEGER NOT NULL DEFAULT 0,
+		sender_ip TEXT NOT NULL DEFAULT '',
+		user_id INTEGER REFERENCES users(id),
 		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
 	);
 	CREATE TABLE IF NOT EXISTS topics (
 		topic TEXT PRIMARY KEY,
 		secret TEXT NOT NULL,
+		messages_expiry_seconds INTEGER NOT NULL DEFAULT 0,
+		max_messages_per_topic INTEGER NOT NULL DEFAULT 0,
+		since_policy TEXT NOT NULL DEFAULT 'all',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE IF NOT EXISTS users (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		username TEXT NOT NULL UNIQUE,
+		password_hash TEXT NOT NULL,
+		role TEXT NOT NULL DEFAULT 'user',
+		tier_id TEXT NOT NULL DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE IF NOT EXISTS tokens (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		prefix TEXT NOT NULL UNIQUE,
+		hash TEXT NOT NULL,
+		label TEXT NOT NULL DEFAULT '',
+		expires_at DATETIME,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		last_used_at DATETIME
+	);
+	CREATE TABLE IF NOT EXISTS topic_acls (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		token_id INTEGER NOT NULL REFERENCES tokens(id),
+		topic_pattern TEXT NOT NULL,
+		permission TEXT NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS access (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL REFERENCES users(id),
+		topic_pattern TEXT NOT NULL,
+		permission TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE IF NOT EXISTS tiers (
+		id TEXT PRIMARY KEY,
+		code TEXT NOT NULL UNIQUE,
+		name TEXT NOT NULL,
+		messages_limit INTEGER NOT NULL DEFAULT 0,
+		messages_expiry_days INTEGER NOT NULL DEFAULT 0,
+		subscriptions_limit INTEGER NOT NULL DEFAULT 0,
+		publish_rate_per_hour INTEGER NOT NULL DEFAULT 0,
+		attachment_file_size_limit INTEGER NOT NULL DEFAULT 0,
+		attachment_total_size_limit INTEGER NOT NULL DEFAULT 0,
 		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
 	);
+	CREATE TABLE IF NOT EXISTS callback_subscriptions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		topic TEXT NOT NULL,
+		callback_url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		lease_seconds INTEGER NOT NULL DEFAULT 0,
+		expires_at DATETIME,
+		verified_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(topic, callback_url)
+	);
 	`
 	_, err := db.conn.Exec(query)
 	return err
 }
 
+// schemaUpgrades lists every column added to a table's CREATE TABLE in
+// migrate() after that table first shipped, in the order the columns
+// were added. migrate() is pure CREATE TABLE IF NOT EXISTS, so it never
+// touches a table that already exists: ensureSchemaUpgrades is what
+// actually lands these columns on a database file from an earlier point
+// in the series.
+var schemaUpgrades = []struct{ table, column, columnDef string }{
+	{"subscriptions", "type", "TEXT NOT NULL DEFAULT 'webpush'"},
+	{"subscriptions", "token", "TEXT NOT NULL DEFAULT ''"},
+	{"subscriptions", "user_id", "INTEGER REFERENCES users(id)"},
+	{"messages", "priority", "INTEGER NOT NULL DEFAULT 3"},
+	{"messages", "tags", "TEXT NOT NULL DEFAULT ''"},
+	{"messages", "click", "TEXT NOT NULL DEFAULT ''"},
+	{"messages", "icon", "TEXT NOT NULL DEFAULT ''"},
+	{"messages", "actions", "TEXT NOT NULL DEFAULT ''"},
+	{"messages", "attachment_id", "TEXT"},
+	{"messages", "attachment_name", "TEXT"},
+	{"messages", "attachment_type", "TEXT"},
+	{"messages", "attachment_size", "INTEGER"},
+	{"messages", "attachment_expires", "DATETIME"},
+	{"messages", "attachment_deleted", "INTEGER NOT NULL DEFAULT 0"},
+	{"messages", "sender_ip", "TEXT NOT NULL DEFAULT ''"},
+	{"messages", "user_id", "INTEGER REFERENCES users(id)"},
+	{"users", "tier_id", "TEXT NOT NULL DEFAULT ''"},
+	{"topics", "messages_expiry_seconds", "INTEGER NOT NULL DEFAULT 0"},
+	{"topics", "max_messages_per_topic", "INTEGER NOT NULL DEFAULT 0"},
+	{"topics", "since_policy", "TEXT NOT NULL DEFAULT 'all'"},
+}
+
+// ensureSchemaUpgrades runs schemaUpgrades against conn, adding each
+// column that isn't already there. It must run before
+// migrateLegacyIntegerIDs, which renames messages/subscriptions aside
+// and copies their rows across: by the time that happens, both tables
+// already carry every column migrate()'s CREATE TABLE expects.
+func (db *DB) ensureSchemaUpgrades() error {
+	for _, u := range schemaUpgrades {
+		if err := db.ensureColumn(u.table, u.column, u.columnDef); err != nil {
+			return fmt.Errorf("failed to add %s.%s: %w", u.table, u.column, err)
+		}
+	}
+	return nil
+}
+
+// ensureColumn adds column to table via ALTER TABLE ... ADD COLUMN
+// columnDef, unless it's already there.
+func (db *DB) ensureColumn(table, column, columnDef string) error {
+	ctype, err := db.columnType(table, column)
+	if err != nil {
+		return err
+	}
+	if ctype != "" {
+		return nil
+	}
+	_, err = db.conn.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, columnDef))
+	return err
+}
+
+// columnType returns the declared type of table's column, via
+// PRAGMA table_info, or "" if the column doesn't exist. migrateLegacyIntegerIDs
+// uses it to tell a database file written before messages/subscriptions
+// switched to text ids apart from one migrate() already brought up to date.
+func (db *DB) columnType(table, column string) (string, error) {
+	rows, err := db.conn.Query(fmt.Sprintf(`PRAGMA table_info(%s)`, table))
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid int
+		var name, ctype string
+		var notnull, pk int
+		var dfltValue sql.NullString
+		if err := rows.Scan(&cid, &name, &ctype, &notnull, &dfltValue, &pk); err != nil {
+			return "", err
+		}
+		if name == column {
+			return ctype, nil
+		}
+	}
+	return "", rows.Err()
+}
+
+// migrateLegacyIntegerIDs rewrites a database file written before messages
+// and subscriptions switched their primary key from an autoincrementing
+// integer to a prefixed random string. SQLite can't ALTER a column's type
+// or primary-key-ness in place, so for each table that's still on the old
+// schema this renames it aside, lets migrate()'s CREATE TABLE statement
+// build the new one, copies the old rows across assigning each a freshly
+// generated id (and, for messages, preserving the old integer id as the
+// new seq column so publish order is unchanged), and drops the old table.
+func (db *DB) migrateLegacyIntegerIDs() error {
+	seqType, err := db.columnType("messages", "seq")
+	if err != nil {
+		return err
+	}
+	if seqType == "" {
+		if err := db.migrateLegacyMessages(); err != nil {
+			return fmt.Errorf("failed to migrate legacy messages table: %w", err)
+		}
+	}
+
+	idType, err := db.columnType("subscriptions", "id")
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(idType, "TEXT") {
+		if err := db.migrateLegacySubscriptions(); err != nil {
+			return fmt.Errorf("failed to migrate legacy subscriptions table: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// legacyMessagesSelectColumns builds the SELECT list migrateLegacyMessages
+// uses to read messages_legacy. id, topic, title, message, and created_at
+// are the columns the genuine pre-series baseline table has; every other
+// column migrate()'s CREATE TABLE now expects was added by a later
+// request, so it's selected as-is if messages_legacy already has it (as
+// ensureSchemaUpgrades should have arranged) and substituted with its
+// CREATE TABLE default otherwise, so this never references a column a
+// legacy table doesn't have.
+func (db *DB) legacyMessagesSelectColumns() (string, error) {
+	optional := []struct{ name, defaultExpr string }{
+		{"priority", "3"},
+		{"tags", "''"},
+		{"click", "''"},
+		{"icon", "''"},
+		{"actions", "''"},
+		{"attachment_id", "NULL"},
+		{"attachment_name", "NULL"},
+		{"attachment_type", "NULL"},
+		{"attachment_size", "NULL"},
+		{"attachment_expires", "NULL"},
+		{"attachment_deleted", "0"},
+		{"sender_ip", "''"},
+		{"user_id", "NULL"},
+	}
+
+	cols := []string{"id", "topic", "title", "message"}
+	for _, o := range optional {
+		ctype, err := db.columnType("messages_legacy", o.name)
+		if err != nil {
+			return "", err
+		}
+		if ctype == "" {
+			cols = append(cols, fmt.Sprintf("%s AS %s", o.defaultExpr, o.name))
+		} else {
+			cols = append(cols, o.name)
+		}
+	}
+	cols = append(cols, "created_at")
+	return strings.Join(cols, ", "), nil
+}
+
+func (db *DB) migrateLegacyMessages() error {
+	if _, err := db.conn.Exec(`ALTER TABLE messages RENAME TO messages_legacy`); err != nil {
+		return err
+	}
+	if err := db.migrate(); err != nil {
+		return err
+	}
+
+	selectCols, err := db.legacyMessagesSelectColumns()
+	if err != nil {
+		return err
+	}
+
+	rows, err := db.conn.Query(fmt.Sprintf(`SELECT %s FROM messages_legacy`, selectCols))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	type legacyMessage struct {
+		seq                                               int64
+		topic, title, message, tags, click, icon, actions string
+		attachmentID, attachmentName, attachmentType      sql.NullString
+		attachmentExpires, senderIP, createdAt            sql.NullString
+		attachmentSize                                    sql.NullInt64
+		attachmentDeleted                                 int
+		priority                                          int
+		userID                                            sql.NullInt64
+	}
+	var legacyRows []legacyMessage
+	for rows.Next() {
+		var m legacyMessage
+		if err := rows.Scan(&m.seq, &m.topic, &m.title, &m.message, &m.priority, &m.tags, &m.click, &m.icon, &m.actions, &m.attachmentID, &m.attachmentName, &m.attachmentType, &m.attachmentSize, &m.attachmentExpires, &m.attachmentDeleted, &m.senderIP, &m.userID, &m.createdAt); err != nil {
+			return err
+		}
+		legacyRows = append(legacyRows, m)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	for _, m := range legacyRows {
+		id, err := util.RandomStringPrefix("msg_", idByteLength)
+		if err != nil {
+			return err
+		}
+		if _, err := db.conn.Exec(
+			`INSERT INTO messages (seq, id, topic, title, message, priority, tags, click, icon, actions, attachment_id, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_deleted, sender_ip, user_id, created_at)
+			 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			m.seq, id, m.topic, m.title, m.message, m.priority, m.tags, m.click, m.icon, m.actions, m.attachmentID, m.attachmentName, m.attachmentType, m.attachmentSize, m.attachmentExpires, m.attachmentDeleted, m.senderIP, m.userID, m.createdAt,
+		); err != nil {
+			return err
+		}
+	}
+
+	_, err = db.conn.Exec(`DROP TABLE messages_legacy`)
+	return err
+}
+
+func (db *DB) migrateLegacySubscriptions() error {
+	if _, err := db.conn.Exec(`ALTER TABLE subscriptions RENAME TO subscriptions_legacy`); err != nil {
+		return err
+	}
+	if err := db.migrate(); err != nil {
+		return err
+	}
+
+	rows, err := db.conn.Query(`SELECT topic, endpoint, p256dh, auth, type, token, user_id, created_at FROM subscriptions_legacy`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	type legacySubscription struct {
+		topic, endpoint, p256dh, auth, subType, token string
+		userID                                        sql.NullInt64
+		createdAt                                     sql.NullString
+	}
+	var legacyRows []legacySubscription
+	for rows.Next() {
+		var s legacySubscription
+		if err := rows.Scan(&s.topic, &s.endpoint, &s.p256dh, &s.auth, &s.subType, &s.token, &s.userID, &s.createdAt); err != nil {
+			return err
+		}
+		legacyRows = append(legacyRows, s)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	for _, s := range legacyRows {
+		id, err := util.RandomStringPrefix("sub_", idByteLength)
+		if err != nil {
+			return err
+		}
+		if _, err := db.conn.Exec(
+			`INSERT INTO subscriptions (id, topic, endpoint, p256dh, auth, type, token, user_id, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			id, s.topic, s.endpoint, s.p256dh, s.auth, s.subType, s.token, s.userID, s.createdAt,
+		); err != nil {
+			return err
+		}
+	}
+
+	_, err = db.conn.Exec(`DROP TABLE subscriptions_legacy`)
+	return err
+}
+
 func (db *DB) ProtectTopic(topic, secret string) error {
 	// Hash the secret using bcrypt before storing
 	hashedSecret, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
@@ -119,21 +557,648 @@ func (db *DB) VerifyTopicSecret(topic, providedSecret string) (bool, error) {
 	return true, nil
 }
 
-func (db *DB) SaveSubscription(topic, endpoint, p256dh, auth string) error {
+// User is an account that owns bearer tokens. TierID is the id of the
+// user's rate/quota tier; empty means no tier has been assigned yet.
+type User struct {
+	ID           int64
+	Username     string
+	PasswordHash string
+	Role         string
+	TierID       string
+	CreatedAt    string
+}
+
+// Token is a bearer token belonging to a user, stored only as a bcrypt
+// hash plus an indexed lookup prefix. ExpiresAt is reset to a fixed
+// extension past the current time on every successful AuthenticateToken
+// call, so a token used at least once per extension window never expires
+// while a forgotten one eventually does.
+type Token struct {
+	ID         int64
+	UserID     int64
+	Prefix     string
+	Hash       string
+	Label      string
+	ExpiresAt  sql.NullString
+	CreatedAt  string
+	LastUsedAt sql.NullString
+}
+
+// TopicACL grants a token a permission on a topic name pattern.
+type TopicACL struct {
+	ID           int64
+	TokenID      int64
+	TopicPattern string
+	Permission   string
+}
+
+// Access grants a user a permission on a topic name pattern directly,
+// independent of any one token (unlike TopicACL, which is scoped to the
+// token that was used to authenticate). ProtectTopic records the
+// protecting user's grant here with permission "owner".
+type Access struct {
+	ID           int64
+	UserID       int64
+	TopicPattern string
+	Permission   string
+	CreatedAt    string
+}
+
+// CreateUser inserts a new user with the given role ("admin" or "user")
+// and returns its id.
+func (db *DB) CreateUser(username, passwordHash, role string) (int64, error) {
+	result, err := db.conn.Exec(`INSERT INTO users (username, password_hash, role) VALUES (?, ?, ?)`, username, passwordHash, role)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// GetUserByID returns the user with the given id, or nil if none exists.
+func (db *DB) GetUserByID(id int64) (*User, error) {
+	var u User
+	err := db.conn.QueryRow(`SELECT id, username, password_hash, role, tier_id, created_at FROM users WHERE id = ?`, id).
+		Scan(&u.ID, &u.Username, &u.PasswordHash, &u.Role, &u.TierID, &u.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// GetUserByUsername returns the user with the given username, or nil if
+// none exists.
+func (db *DB) GetUserByUsername(username string) (*User, error) {
+	var u User
+	err := db.conn.QueryRow(`SELECT id, username, password_hash, role, tier_id, created_at FROM users WHERE username = ?`, username).
+		Scan(&u.ID, &u.Username, &u.PasswordHash, &u.Role, &u.TierID, &u.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// AuthenticateUser verifies password against username's stored bcrypt
+// hash and returns the user on success. It returns (nil, nil), not an
+// error, for both "no such user" and "wrong password", so callers can't
+// accidentally distinguish the two and leak which usernames exist.
+func (db *DB) AuthenticateUser(username, password string) (*User, error) {
+	user, err := db.GetUserByUsername(username)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, nil
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+		return nil, nil
+	}
+	return user, nil
+}
+
+// ListUsers returns every account, ordered by username.
+func (db *DB) ListUsers() ([]User, error) {
+	rows, err := db.conn.Query(`SELECT id, username, password_hash, role, tier_id, created_at FROM users ORDER BY username`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.Username, &u.PasswordHash, &u.Role, &u.TierID, &u.CreatedAt); err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// DeleteUser removes a user and every token/ACL it owns.
+func (db *DB) DeleteUser(username string) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var userID int64
+	err = tx.QueryRow(`SELECT id FROM users WHERE username = ?`, username).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("no such user %q", username)
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM topic_acls WHERE token_id IN (SELECT id FROM tokens WHERE user_id = ?)`, userID); err != nil {
+		return fmt.Errorf("failed to delete access grants: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM tokens WHERE user_id = ?`, userID); err != nil {
+		return fmt.Errorf("failed to delete tokens: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM access WHERE user_id = ?`, userID); err != nil {
+		return fmt.Errorf("failed to delete access grants: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM users WHERE id = ?`, userID); err != nil {
+		return fmt.Errorf("failed to delete user: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// UpdateUserPassword sets a new password hash for username.
+func (db *DB) UpdateUserPassword(username, passwordHash string) error {
+	_, err := db.conn.Exec(`UPDATE users SET password_hash = ? WHERE username = ?`, passwordHash, username)
+	return err
+}
+
+// GetACLsByUsername returns every topic grant attached to any token owned
+// by username, so a caller authenticated by password (rather than by a
+// specific bearer token) can still be checked against the grants they hold.
+func (db *DB) GetACLsByUsername(username string) ([]TopicACL, error) {
+	rows, err := db.conn.Query(`
+		SELECT topic_acls.id, topic_acls.token_id, topic_acls.topic_pattern, topic_acls.permission
+		FROM topic_acls
+		JOIN tokens ON tokens.id = topic_acls.token_id
+		JOIN users ON users.id = tokens.user_id
+		WHERE users.username = ?`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var acls []TopicACL
+	for rows.Next() {
+		var a TopicACL
+		if err := rows.Scan(&a.ID, &a.TokenID, &a.TopicPattern, &a.Permission); err != nil {
+			return nil, err
+		}
+		acls = append(acls, a)
+	}
+	return acls, rows.Err()
+}
+
+// CreateToken inserts a new bearer token for userID, expiring after ttl
+// (zero means never), and returns its id.
+func (db *DB) CreateToken(userID int64, prefix, hash, label string, ttl time.Duration) (int64, error) {
+	var expiresAt sql.NullString
+	if ttl > 0 {
+		expiresAt = sql.NullString{String: time.Now().Add(ttl).UTC().Format(sqliteTimeLayout), Valid: true}
+	}
+
+	result, err := db.conn.Exec(
+		`INSERT INTO tokens (user_id, prefix, hash, label, expires_at) VALUES (?, ?, ?, ?, ?)`,
+		userID, prefix, hash, label, expiresAt,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// GetTokenByPrefix returns the token with the given lookup prefix, or
+// nil if none exists.
+func (db *DB) GetTokenByPrefix(prefix string) (*Token, error) {
+	var t Token
+	err := db.conn.QueryRow(
+		`SELECT id, user_id, prefix, hash, label, expires_at, created_at, last_used_at FROM tokens WHERE prefix = ?`, prefix,
+	).Scan(&t.ID, &t.UserID, &t.Prefix, &t.Hash, &t.Label, &t.ExpiresAt, &t.CreatedAt, &t.LastUsedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// TouchToken records that a token was just used to authenticate a request.
+func (db *DB) TouchToken(tokenID int64) error {
+	_, err := db.conn.Exec(`UPDATE tokens SET last_used_at = CURRENT_TIMESTAMP WHERE id = ?`, tokenID)
+	return err
+}
+
+// ErrTokenExpired is returned by AuthenticateToken for a token that
+// verified correctly but has passed its expires_at.
+var ErrTokenExpired = errors.New("token expired")
+
+// AuthenticateToken looks up the token with lookup prefix, verifies
+// tokenString against its bcrypt hash, and rejects it if expired. On
+// success it resets expires_at to extension from now (renewing active
+// tokens so only forgotten ones actually expire), records last_used_at,
+// and prunes the owning user's tokens down to maxTokensPerUser (oldest
+// first), so a user who keeps minting tokens can't accumulate unbounded
+// rows. It returns (nil, nil), not an error, when the token doesn't exist
+// or doesn't verify.
+func (db *DB) AuthenticateToken(prefix, tokenString string, extension time.Duration, maxTokensPerUser int) (*Token, error) {
+	tok, err := db.GetTokenByPrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+	if tok == nil {
+		return nil, nil
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(tok.Hash), []byte(tokenString)); err != nil {
+		return nil, nil
+	}
+
+	if tok.ExpiresAt.Valid {
+		expiresAt, err := time.Parse(sqliteTimeLayout, tok.ExpiresAt.String)
+		if err == nil && time.Now().After(expiresAt) {
+			return nil, ErrTokenExpired
+		}
+	}
+
+	newExpiry := sql.NullString{String: time.Now().Add(extension).UTC().Format(sqliteTimeLayout), Valid: extension > 0}
+	if _, err := db.conn.Exec(
+		`UPDATE tokens SET last_used_at = CURRENT_TIMESTAMP, expires_at = ? WHERE id = ?`,
+		newExpiry, tok.ID,
+	); err != nil {
+		return nil, err
+	}
+
+	if err := db.pruneTokens(tok.UserID, maxTokensPerUser); err != nil {
+		return nil, err
+	}
+
+	return tok, nil
+}
+
+// pruneTokens deletes the oldest tokens owned by userID beyond the most
+// recent max, created_at descending. max <= 0 disables pruning.
+func (db *DB) pruneTokens(userID int64, max int) error {
+	if max <= 0 {
+		return nil
+	}
+	_, err := db.conn.Exec(`
+		DELETE FROM tokens WHERE user_id = ? AND id NOT IN (
+			SELECT id FROM tokens WHERE user_id = ? ORDER BY created_at DESC LIMIT ?
+		)`, userID, userID, max)
+	return err
+}
+
+// Allow grants userID permission on topicPattern directly, independent of
+// any token. permission is typically "read", "write", "read-write", or
+// "owner".
+func (db *DB) Allow(userID int64, topicPattern, permission string) error {
+	_, err := db.conn.Exec(
+		`INSERT INTO access (user_id, topic_pattern, permission) VALUES (?, ?, ?)`,
+		userID, topicPattern, permission,
+	)
+	return err
+}
+
+// GetAccessByUserID returns every direct grant userID holds.
+func (db *DB) GetAccessByUserID(userID int64) ([]Access, error) {
+	rows, err := db.conn.Query(`SELECT id, user_id, topic_pattern, permission, created_at FROM access WHERE user_id = ?`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var grants []Access
+	for rows.Next() {
+		var a Access
+		if err := rows.Scan(&a.ID, &a.UserID, &a.TopicPattern, &a.Permission, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		grants = append(grants, a)
+	}
+	return grants, rows.Err()
+}
+
+// Tier bounds how many messages/subscriptions a user may hold at once,
+// how fast they may publish, and how long their messages are kept before
+// the retention sweeper expires them. AssignTier attaches one to a
+// user's tier_id; a user with no tier assigned is subject to no
+// tier-based limit at all (only the IP-based visitor limits still apply).
+type Tier struct {
+	ID                 string
+	Code               string
+	Name               string
+	MessagesLimit      int
+	MessagesExpiryDays int
+	SubscriptionsLimit int
+	PublishRatePerHour int
+
+	// AttachmentFileSizeLimit and AttachmentTotalSizeLimit bound, in
+	// bytes, a single attachment upload and the sum of a user's
+	// not-yet-expired attachments respectively. 0 means unlimited, same
+	// as every other Tier dimension.
+	AttachmentFileSizeLimit  int64
+	AttachmentTotalSizeLimit int64
+
+	CreatedAt string
+}
+
+// CreateTier inserts a new tier and returns its generated id ("ti_" plus
+// 8 random hex bytes, matching the "tk_" scheme bearer tokens use). A
+// limit of 0 means unlimited for that dimension.
+func (db *DB) CreateTier(code, name string, messagesLimit, messagesExpiryDays, subscriptionsLimit, publishRatePerHour int, attachmentFileSizeLimit, attachmentTotalSizeLimit int64) (string, error) {
+	id, err := util.RandomStringPrefix("ti_", idByteLength)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate tier id: %w", err)
+	}
+
+	_, err = db.conn.Exec(
+		`INSERT INTO tiers (id, code, name, messages_limit, messages_expiry_days, subscriptions_limit, publish_rate_per_hour, attachment_file_size_limit, attachment_total_size_limit) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		id, code, name, messagesLimit, messagesExpiryDays, subscriptionsLimit, publishRatePerHour, attachmentFileSizeLimit, attachmentTotalSizeLimit,
+	)
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// GetTierByCode returns the tier with the given code, or nil if none exists.
+func (db *DB) GetTierByCode(code string) (*Tier, error) {
+	var t Tier
+	err := db.conn.QueryRow(
+		`SELECT id, code, name, messages_limit, messages_expiry_days, subscriptions_limit, publish_rate_per_hour, attachment_file_size_limit, attachment_total_size_limit, created_at FROM tiers WHERE code = ?`, code,
+	).Scan(&t.ID, &t.Code, &t.Name, &t.MessagesLimit, &t.MessagesExpiryDays, &t.SubscriptionsLimit, &t.PublishRatePerHour, &t.AttachmentFileSizeLimit, &t.AttachmentTotalSizeLimit, &t.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// GetTierByID returns the tier with the given id, or nil if none exists.
+func (db *DB) GetTierByID(id string) (*Tier, error) {
+	var t Tier
+	err := db.conn.QueryRow(
+		`SELECT id, code, name, messages_limit, messages_expiry_days, subscriptions_limit, publish_rate_per_hour, attachment_file_size_limit, attachment_total_size_limit, created_at FROM tiers WHERE id = ?`, id,
+	).Scan(&t.ID, &t.Code, &t.Name, &t.MessagesLimit, &t.MessagesExpiryDays, &t.SubscriptionsLimit, &t.PublishRatePerHour, &t.AttachmentFileSizeLimit, &t.AttachmentTotalSizeLimit, &t.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// ListTiers returns every defined tier, ordered by code.
+func (db *DB) ListTiers() ([]Tier, error) {
+	rows, err := db.conn.Query(`SELECT id, code, name, messages_limit, messages_expiry_days, subscriptions_limit, publish_rate_per_hour, attachment_file_size_limit, attachment_total_size_limit, created_at FROM tiers ORDER BY code`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tiers []Tier
+	for rows.Next() {
+		var t Tier
+		if err := rows.Scan(&t.ID, &t.Code, &t.Name, &t.MessagesLimit, &t.MessagesExpiryDays, &t.SubscriptionsLimit, &t.PublishRatePerHour, &t.AttachmentFileSizeLimit, &t.AttachmentTotalSizeLimit, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		tiers = append(tiers, t)
+	}
+	return tiers, rows.Err()
+}
+
+// AssignTier attaches the tier identified by tierID to userID.
+func (db *DB) AssignTier(userID int64, tierID string) error {
+	_, err := db.conn.Exec(`UPDATE users SET tier_id = ? WHERE id = ?`, tierID, userID)
+	return err
+}
+
+// MessagesUsedByUser returns how many messages userID has published in
+// total, for comparison against their tier's MessagesLimit.
+func (db *DB) MessagesUsedByUser(userID int64) (int, error) {
+	var count int
+	err := db.conn.QueryRow(`SELECT COUNT(*) FROM messages WHERE user_id = ?`, userID).Scan(&count)
+	return count, err
+}
+
+// SubscriptionsUsedByUser returns how many subscriptions userID currently
+// holds, for comparison against their tier's SubscriptionsLimit.
+func (db *DB) SubscriptionsUsedByUser(userID int64) (int, error) {
+	var count int
+	err := db.conn.QueryRow(`SELECT COUNT(*) FROM subscriptions WHERE user_id = ?`, userID).Scan(&count)
+	return count, err
+}
+
+// MessagesPublishedSince returns how many messages userID has published
+// within the trailing window, for comparison against their tier's
+// PublishRatePerHour.
+func (db *DB) MessagesPublishedSince(userID int64, window time.Duration) (int, error) {
+	var count int
+	err := db.conn.QueryRow(
+		`SELECT COUNT(*) FROM messages WHERE user_id = ? AND created_at > datetime('now', ?)`,
+		userID, fmt.Sprintf("-%d seconds", int(window.Seconds())),
+	).Scan(&count)
+	return count, err
+}
+
+// DeleteExpiredMessagesForTiers deletes messages belonging to users whose
+// tier sets a MessagesExpiryDays, one tier at a time, and returns the
+// total number of rows removed. It generalizes DeleteOldMessages (a
+// single global cutoff applied to every message) to the per-user cutoff
+// a tier assigns; messages from users with no tier, or a tier with
+// MessagesExpiryDays of 0, are left for DeleteOldMessages alone.
+func (db *DB) DeleteExpiredMessagesForTiers() (int64, error) {
+	tiers, err := db.ListTiers()
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, t := range tiers {
+		if t.MessagesExpiryDays <= 0 {
+			continue
+		}
+		result, err := db.conn.Exec(
+			`DELETE FROM messages WHERE user_id IN (SELECT id FROM users WHERE tier_id = ?) AND created_at < datetime('now', ?)`,
+			t.ID, fmt.Sprintf("-%d days", t.MessagesExpiryDays),
+		)
+		if err != nil {
+			return total, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return total, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// TopicRetention is a topic's message retention policy: how long a
+// message survives (MessagesExpirySeconds, 0 meaning never) and how many
+// of a topic's newest messages are kept (MaxMessagesPerTopic, 0 meaning
+// unlimited). SincePolicy tells a reconnecting subscriber which messages
+// to replay: "all", "last_24h", or "since_last_read".
+type TopicRetention struct {
+	Topic                 string
+	MessagesExpirySeconds int
+	MaxMessagesPerTopic   int
+	SincePolicy           string
+}
+
+// SetTopicRetention sets topic's retention policy, the per-topic
+// generalization of the global MESSAGE_RETENTION_DAYS DeleteOldMessages
+// enforces. An empty sincePolicy defaults to "all". Like ProtectTopic, it
+// upserts the topics row without touching the secret column, so setting
+// retention on a not-yet-protected topic doesn't accidentally protect it.
+func (db *DB) SetTopicRetention(topic string, messagesExpirySeconds, maxMessagesPerTopic int, sincePolicy string) error {
+	if sincePolicy == "" {
+		sincePolicy = "all"
+	}
+
 	query := `
-	INSERT INTO subscriptions (topic, endpoint, p256dh, auth)
-	VALUES (?, ?, ?, ?)
-	ON CONFLICT(topic, endpoint) DO UPDATE SET
-		p256dh = excluded.p256dh,
-		auth = excluded.auth
+	INSERT INTO topics (topic, secret, messages_expiry_seconds, max_messages_per_topic, since_policy)
+	VALUES (?, '', ?, ?, ?)
+	ON CONFLICT(topic) DO UPDATE SET
+		messages_expiry_seconds = excluded.messages_expiry_seconds,
+		max_messages_per_topic = excluded.max_messages_per_topic,
+		since_policy = excluded.since_policy
 	`
-	_, err := db.conn.Exec(query, topic, endpoint, p256dh, auth)
+	_, err := db.conn.Exec(query, topic, messagesExpirySeconds, maxMessagesPerTopic, sincePolicy)
+	return err
+}
+
+// ListTopicRetentionPolicies returns every topic that has a
+// messages_expiry_seconds or max_messages_per_topic set, for the
+// cleanup sweeper to enforce one topic at a time.
+func (db *DB) ListTopicRetentionPolicies() ([]TopicRetention, error) {
+	rows, err := db.conn.Query(
+		`SELECT topic, messages_expiry_seconds, max_messages_per_topic, since_policy FROM topics
+		 WHERE messages_expiry_seconds > 0 OR max_messages_per_topic > 0`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var policies []TopicRetention
+	for rows.Next() {
+		var p TopicRetention
+		if err := rows.Scan(&p.Topic, &p.MessagesExpirySeconds, &p.MaxMessagesPerTopic, &p.SincePolicy); err != nil {
+			return nil, err
+		}
+		policies = append(policies, p)
+	}
+	return policies, rows.Err()
+}
+
+// DeleteExpiredMessagesForTopics enforces every topic's retention policy
+// and returns the total number of rows removed. It generalizes
+// DeleteOldMessages (a single global cutoff applied to every message) to
+// a per-topic cutoff and a per-topic cap on how many messages are kept,
+// the same way DeleteExpiredMessagesForTiers generalizes it per-user.
+func (db *DB) DeleteExpiredMessagesForTopics() (int64, error) {
+	policies, err := db.ListTopicRetentionPolicies()
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, p := range policies {
+		if p.MessagesExpirySeconds > 0 {
+			result, err := db.conn.Exec(
+				`DELETE FROM messages WHERE topic = ? AND created_at < datetime('now', ?)`,
+				p.Topic, fmt.Sprintf("-%d seconds", p.MessagesExpirySeconds),
+			)
+			if err != nil {
+				return total, err
+			}
+			n, err := result.RowsAffected()
+			if err != nil {
+				return total, err
+			}
+			total += n
+		}
+
+		if p.MaxMessagesPerTopic > 0 {
+			result, err := db.conn.Exec(
+				`DELETE FROM messages WHERE topic = ? AND seq NOT IN (
+					SELECT seq FROM messages WHERE topic = ? ORDER BY seq DESC LIMIT ?
+				)`,
+				p.Topic, p.Topic, p.MaxMessagesPerTopic,
+			)
+			if err != nil {
+				return total, err
+			}
+			n, err := result.RowsAffected()
+			if err != nil {
+				return total, err
+			}
+			total += n
+		}
+	}
+	return total, nil
+}
+
+// CreateTopicACL grants tokenID permission on topicPattern.
+func (db *DB) CreateTopicACL(tokenID int64, topicPattern, permission string) error {
+	_, err := db.conn.Exec(
+		`INSERT INTO topic_acls (token_id, topic_pattern, permission) VALUES (?, ?, ?)`,
+		tokenID, topicPattern, permission,
+	)
+	return err
+}
+
+// GetACLsByToken returns every topic grant attached to tokenID.
+func (db *DB) GetACLsByToken(tokenID int64) ([]TopicACL, error) {
+	rows, err := db.conn.Query(`SELECT id, token_id, topic_pattern, permission FROM topic_acls WHERE token_id = ?`, tokenID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var acls []TopicACL
+	for rows.Next() {
+		var a TopicACL
+		if err := rows.Scan(&a.ID, &a.TokenID, &a.TopicPattern, &a.Permission); err != nil {
+			return nil, err
+		}
+		acls = append(acls, a)
+	}
+	return acls, rows.Err()
+}
+
+func (db *DB) SaveSubscription(topic, endpoint, p256dh, auth string, userID int64) error {
+	id, err := util.RandomStringPrefix("sub_", idByteLength)
+	if err != nil {
+		return fmt.Errorf("failed to generate subscription id: %w", err)
+	}
+	_, err = db.insertSubscription.Exec(id, topic, endpoint, p256dh, auth, userIDArg(userID))
 	return err
 }
 
+// SaveFCMSubscription records an FCM registration token as a subscriber of
+// topic. It's stored in the same subscriptions table as web push, keyed
+// off type = "fcm"; the token also fills the endpoint column so the
+// existing UNIQUE(topic, endpoint) constraint dedupes repeat registrations
+// of the same token the way it already does for web push endpoints.
+func (db *DB) SaveFCMSubscription(topic, token string, userID int64) error {
+	id, err := util.RandomStringPrefix("sub_", idByteLength)
+	if err != nil {
+		return fmt.Errorf("failed to generate subscription id: %w", err)
+	}
+	_, err = db.insertFCMSubscription.Exec(id, topic, token, token, userIDArg(userID))
+	return err
+}
+
+// GetSubscriptionsByTopic returns every subscriber of topic for the fanout
+// loop to dispatch to: web push/FCM subscriptions from the subscriptions
+// table, plus verified, unexpired callback subscriptions from
+// callback_subscriptions folded in as Subscription values of type
+// "callback" (Endpoint holding the callback URL and Auth holding its HMAC
+// secret, the same reuse-the-struct approach type "fcm" already uses for
+// its registration token).
 func (db *DB) GetSubscriptionsByTopic(topic string) ([]Subscription, error) {
-	query := `SELECT id, topic, endpoint, p256dh, auth FROM subscriptions WHERE topic = ?`
-	rows, err := db.conn.Query(query, topic)
+	rows, err := db.selectSubscriptionsByTopic.Query(topic)
 	if err != nil {
 		return nil, err
 	}
@@ -142,13 +1207,30 @@ func (db *DB) GetSubscriptionsByTopic(topic string) ([]Subscription, error) {
 	var subscriptions []Subscription
 	for rows.Next() {
 		var sub Subscription
-		if err := rows.Scan(&sub.ID, &sub.Topic, &sub.Endpoint, &sub.P256dh, &sub.Auth); err != nil {
+		if err := rows.Scan(&sub.ID, &sub.Topic, &sub.Endpoint, &sub.P256dh, &sub.Auth, &sub.Type, &sub.Token); err != nil {
 			return nil, err
 		}
 		subscriptions = append(subscriptions, sub)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
-	return subscriptions, rows.Err()
+	callbacks, err := db.GetCallbackSubscriptionsByTopic(topic)
+	if err != nil {
+		return nil, err
+	}
+	for _, cb := range callbacks {
+		subscriptions = append(subscriptions, Subscription{
+			ID:       fmt.Sprintf("cb_%d", cb.ID),
+			Topic:    cb.Topic,
+			Endpoint: cb.CallbackURL,
+			Auth:     cb.Secret,
+			Type:     "callback",
+		})
+	}
+
+	return subscriptions, nil
 }
 
 func (db *DB) DeleteSubscription(endpoint string) error {
@@ -157,31 +1239,251 @@ func (db *DB) DeleteSubscription(endpoint string) error {
 	return err
 }
 
-type Message struct {
-	ID        int
-	Topic     string
-	Title     string
-	Message   string
-	CreatedAt string
+// CallbackSubscription is a WebSub-style subscriber registered via
+// POST /subscribe/{topic}/callback: pushem POSTs a signed payload to
+// CallbackURL instead of delivering through a push service.
+type CallbackSubscription struct {
+	ID           int
+	Topic        string
+	CallbackURL  string
+	Secret       string
+	LeaseSeconds int
+	ExpiresAt    string
+	VerifiedAt   string
 }
 
-func (db *DB) SaveMessage(topic, title, message string) error {
+// SaveCallbackSubscription records a callback subscription whose
+// verification handshake has already succeeded, setting expires_at
+// leaseSeconds out from now. Re-subscribing to the same (topic,
+// callback_url) renews the lease and rotates the secret, the same
+// upsert-on-conflict renewal SaveSubscription gives web push endpoints.
+func (db *DB) SaveCallbackSubscription(topic, callbackURL, secret string, leaseSeconds int) error {
 	query := `
-	INSERT INTO messages (topic, title, message)
-	VALUES (?, ?, ?)
+	INSERT INTO callback_subscriptions (topic, callback_url, secret, lease_seconds, expires_at, verified_at)
+	VALUES (?, ?, ?, ?, datetime('now', ?), CURRENT_TIMESTAMP)
+	ON CONFLICT(topic, callback_url) DO UPDATE SET
+		secret = excluded.secret,
+		lease_seconds = excluded.lease_seconds,
+		expires_at = excluded.expires_at,
+		verified_at = excluded.verified_at
 	`
-	_, err := db.conn.Exec(query, topic, title, message)
+	_, err := db.conn.Exec(query, topic, callbackURL, secret, leaseSeconds, fmt.Sprintf("+%d seconds", leaseSeconds))
+	return err
+}
+
+// GetCallbackSubscriptionsByTopic returns every callback subscription for
+// topic whose lease hasn't expired yet.
+func (db *DB) GetCallbackSubscriptionsByTopic(topic string) ([]CallbackSubscription, error) {
+	rows, err := db.conn.Query(
+		`SELECT id, topic, callback_url, secret, lease_seconds, expires_at, verified_at FROM callback_subscriptions WHERE topic = ? AND expires_at > datetime('now')`,
+		topic,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subs []CallbackSubscription
+	for rows.Next() {
+		var cb CallbackSubscription
+		if err := rows.Scan(&cb.ID, &cb.Topic, &cb.CallbackURL, &cb.Secret, &cb.LeaseSeconds, &cb.ExpiresAt, &cb.VerifiedAt); err != nil {
+			return nil, err
+		}
+		subs = append(subs, cb)
+	}
+	return subs, rows.Err()
+}
+
+// DeleteCallbackSubscription removes a callback subscription, called when
+// dispatch learns (via webpush.ErrSubscriptionExpired) that callbackURL no
+// longer wants delivery.
+func (db *DB) DeleteCallbackSubscription(callbackURL string) error {
+	_, err := db.conn.Exec(`DELETE FROM callback_subscriptions WHERE callback_url = ?`, callbackURL)
+	return err
+}
+
+// MessageAction is a single Web Push Notification action button, mapped
+// from/to the "actions" JSON field and the X-Actions header.
+type MessageAction struct {
+	Action string `json:"action"`
+	Title  string `json:"title"`
+	URL    string `json:"url"`
+}
+
+type Message struct {
+	// Seq is the internal autoincrementing publish order, used for
+	// stream resumption (see stream.Message); ID is the public "msg_"
+	// prefixed identifier exposed over the API.
+	Seq      int64
+	ID       string
+	Topic    string
+	Title    string
+	Message  string
+	Priority int
+	Tags     []string
+	Click    string
+	Icon     string
+	Actions  []MessageAction
+
+	CreatedAt string
+
+	// Attachment fields are set only for messages published via
+	// PUT /publish/{topic}; AttachmentID is empty otherwise.
+	AttachmentID   string
+	AttachmentName string
+	AttachmentType string
+	AttachmentSize int64
+}
+
+// RichFields carries the ntfy-style fields a published message can
+// set beyond title/message, kept as a struct since SaveMessage and
+// SaveMessageWithAttachment both need to persist the same set of them.
+type RichFields struct {
+	Priority int
+	Tags     []string
+	Click    string
+	Icon     string
+	Actions  []MessageAction
+}
+
+func (f RichFields) marshalActions() (string, error) {
+	if len(f.Actions) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(f.Actions)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// userIDArg converts userID to the value SaveMessage/SaveSubscription bind
+// against the nullable user_id column: 0 (no identified caller) becomes
+// SQL NULL rather than a bogus foreign key.
+func userIDArg(userID int64) interface{} {
+	if userID <= 0 {
+		return nil
+	}
+	return userID
+}
+
+// SaveMessage inserts the message and returns its seq and created_at, so
+// callers that fan it out to live listeners (e.g. Handler.Publish) can
+// publish those exact values instead of re-querying GetMessagesByTopic
+// and guessing which row they just inserted.
+func (db *DB) SaveMessage(topic, title, message string, rich RichFields, userID int64) (seq int64, createdAt string, err error) {
+	actionsJSON, err := rich.marshalActions()
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to marshal actions: %w", err)
+	}
+
+	id, err := util.RandomStringPrefix("msg_", idByteLength)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to generate message id: %w", err)
+	}
+
+	createdAt = time.Now().UTC().Format(sqliteTimeLayout)
+	result, err := db.insertMessage.Exec(id, topic, title, message, rich.Priority, strings.Join(rich.Tags, ","), rich.Click, rich.Icon, actionsJSON, userIDArg(userID), createdAt)
+	if err != nil {
+		return 0, "", err
+	}
+
+	seq, err = result.LastInsertId()
+	return seq, createdAt, err
+}
+
+// SaveMessageWithAttachment records a message published alongside a file
+// stored in a filecache.Cache, so history and fan-out can reference it.
+// expiresAt lets AttachmentBytesUsedByUser/AttachmentBytesUsedBySender
+// tell a live attachment from one the janitor has already swept, and
+// senderIP gives unauthenticated callers (userID 0) a quota key. Like
+// SaveMessage, it returns the new row's seq and created_at so the caller
+// can fan it out without re-querying.
+func (db *DB) SaveMessageWithAttachment(topic, title, message string, rich RichFields, attachmentID, attachmentName, attachmentType string, attachmentSize int64, userID int64, expiresAt time.Time, senderIP string) (seq int64, createdAt string, err error) {
+	actionsJSON, err := rich.marshalActions()
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to marshal actions: %w", err)
+	}
+
+	id, err := util.RandomStringPrefix("msg_", idByteLength)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to generate message id: %w", err)
+	}
+
+	createdAt = time.Now().UTC().Format(sqliteTimeLayout)
+	result, err := db.insertMessageWithAttachment.Exec(id, topic, title, message, rich.Priority, strings.Join(rich.Tags, ","), rich.Click, rich.Icon, actionsJSON, attachmentID, attachmentName, attachmentType, attachmentSize, expiresAt.UTC().Format(sqliteTimeLayout), senderIP, userIDArg(userID), createdAt)
+	if err != nil {
+		return 0, "", err
+	}
+
+	seq, err = result.LastInsertId()
+	return seq, createdAt, err
+}
+
+// AttachmentBytesUsedByUser sums the size of every attachment userID has
+// published that hasn't expired or been swept yet, for comparison
+// against their tier's AttachmentTotalSizeLimit.
+func (db *DB) AttachmentBytesUsedByUser(userID int64) (int64, error) {
+	var total sql.NullInt64
+	err := db.conn.QueryRow(
+		`SELECT SUM(attachment_size) FROM messages WHERE user_id = ? AND attachment_id != '' AND attachment_deleted = 0 AND attachment_expires >= datetime('now')`,
+		userID,
+	).Scan(&total)
+	return total.Int64, err
+}
+
+// AttachmentBytesUsedBySender sums the size of every attachment published
+// from ip by a caller with no identified account, for comparison against
+// their tier's AttachmentTotalSizeLimit (the default tier, if one exists).
+func (db *DB) AttachmentBytesUsedBySender(ip string) (int64, error) {
+	var total sql.NullInt64
+	err := db.conn.QueryRow(
+		`SELECT SUM(attachment_size) FROM messages WHERE user_id IS NULL AND sender_ip = ? AND attachment_id != '' AND attachment_deleted = 0 AND attachment_expires >= datetime('now')`,
+		ip,
+	).Scan(&total)
+	return total.Int64, err
+}
+
+// SelectAttachmentsExpired returns every message whose attachment has
+// passed its attachment_expires and hasn't been swept yet, for a janitor
+// goroutine to delete from the attachment store and then mark via
+// MarkAttachmentDeleted.
+func (db *DB) SelectAttachmentsExpired() ([]Message, error) {
+	rows, err := db.conn.Query(
+		`SELECT seq, id, topic, attachment_id, attachment_name, attachment_type, attachment_size FROM messages WHERE attachment_id != '' AND attachment_deleted = 0 AND attachment_expires < datetime('now')`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []Message
+	for rows.Next() {
+		var msg Message
+		if err := rows.Scan(&msg.Seq, &msg.ID, &msg.Topic, &msg.AttachmentID, &msg.AttachmentName, &msg.AttachmentType, &msg.AttachmentSize); err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+// MarkAttachmentDeleted records that messageID's attachment has been
+// removed from the attachment store, so SelectAttachmentsExpired and the
+// quota sums above stop counting it.
+func (db *DB) MarkAttachmentDeleted(messageID string) error {
+	_, err := db.conn.Exec(`UPDATE messages SET attachment_deleted = 1 WHERE id = ?`, messageID)
 	return err
 }
 
 func (db *DB) GetMessagesByTopic(topic string) ([]Message, error) {
 	query := `
-	SELECT id, topic, title, message, created_at 
-	FROM messages 
-	WHERE topic = ? 
-	ORDER BY created_at DESC 
+	SELECT seq, id, topic, title, message, priority, tags, click, icon, actions, attachment_id, attachment_name, attachment_type, attachment_size, created_at
+	FROM messages
+	WHERE topic = ?
+	ORDER BY created_at DESC
 	LIMIT 50`
-	
+
 	rows, err := db.conn.Query(query, topic)
 	if err != nil {
 		return nil, err
@@ -191,15 +1493,94 @@ func (db *DB) GetMessagesByTopic(topic string) ([]Message, error) {
 	var messages []Message
 	for rows.Next() {
 		var msg Message
-		if err := rows.Scan(&msg.ID, &msg.Topic, &msg.Title, &msg.Message, &msg.CreatedAt); err != nil {
+		var tags, actionsJSON string
+		var attachmentID, attachmentName, attachmentType sql.NullString
+		var attachmentSize sql.NullInt64
+		if err := rows.Scan(&msg.Seq, &msg.ID, &msg.Topic, &msg.Title, &msg.Message, &msg.Priority, &tags, &msg.Click, &msg.Icon, &actionsJSON, &attachmentID, &attachmentName, &attachmentType, &attachmentSize, &msg.CreatedAt); err != nil {
 			return nil, err
 		}
+		if tags != "" {
+			msg.Tags = strings.Split(tags, ",")
+		}
+		if actionsJSON != "" {
+			if err := json.Unmarshal([]byte(actionsJSON), &msg.Actions); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal actions: %w", err)
+			}
+		}
+		msg.AttachmentID = attachmentID.String
+		msg.AttachmentName = attachmentName.String
+		msg.AttachmentType = attachmentType.String
+		msg.AttachmentSize = attachmentSize.Int64
 		messages = append(messages, msg)
 	}
 
 	return messages, rows.Err()
 }
 
+// GetMessagesByTopicSince returns topic's messages created after since,
+// oldest first, for a reconnecting subscriber to replay instead of
+// fetching (and re-filtering) GetMessagesByTopic's whole LIMIT 50 window.
+// It does not read a topic's since_policy; the caller passes since
+// directly.
+func (db *DB) GetMessagesByTopicSince(topic string, since time.Time) ([]Message, error) {
+	query := `
+	SELECT seq, id, topic, title, message, priority, tags, click, icon, actions, attachment_id, attachment_name, attachment_type, attachment_size, created_at
+	FROM messages
+	WHERE topic = ? AND created_at > ?
+	ORDER BY created_at ASC`
+
+	rows, err := db.conn.Query(query, topic, since.UTC().Format(sqliteTimeLayout))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []Message
+	for rows.Next() {
+		var msg Message
+		var tags, actionsJSON string
+		var attachmentID, attachmentName, attachmentType sql.NullString
+		var attachmentSize sql.NullInt64
+		if err := rows.Scan(&msg.Seq, &msg.ID, &msg.Topic, &msg.Title, &msg.Message, &msg.Priority, &tags, &msg.Click, &msg.Icon, &actionsJSON, &attachmentID, &attachmentName, &attachmentType, &attachmentSize, &msg.CreatedAt); err != nil {
+			return nil, err
+		}
+		if tags != "" {
+			msg.Tags = strings.Split(tags, ",")
+		}
+		if actionsJSON != "" {
+			if err := json.Unmarshal([]byte(actionsJSON), &msg.Actions); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal actions: %w", err)
+			}
+		}
+		msg.AttachmentID = attachmentID.String
+		msg.AttachmentName = attachmentName.String
+		msg.AttachmentType = attachmentType.String
+		msg.AttachmentSize = attachmentSize.Int64
+		messages = append(messages, msg)
+	}
+
+	return messages, rows.Err()
+}
+
+// DeleteMessage removes a single message from a topic's history,
+// verifying it actually belongs to that topic first.
+func (db *DB) DeleteMessage(topic string, messageID string) error {
+	var owner string
+	err := db.conn.QueryRow("SELECT topic FROM messages WHERE id = ?", messageID).Scan(&owner)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("message not found")
+	}
+	if err != nil {
+		return err
+	}
+	if owner != topic {
+		return fmt.Errorf("message does not belong to topic")
+	}
+
+	_, err = db.conn.Exec("DELETE FROM messages WHERE id = ?", messageID)
+	return err
+}
+
 func (db *DB) ClearMessages(topic string) error {
 	query := `DELETE FROM messages WHERE topic = ?`
 	_, err := db.conn.Exec(query, topic)
@@ -239,7 +1620,7 @@ func (db *DB) ListAllTopics() ([]TopicInfo, error) {
 	// Get all unique topics from subscriptions
 	query := `
 		SELECT DISTINCT s.topic,
-			CASE WHEN t.secret IS NOT NULL THEN 1 ELSE 0 END as is_protected,
+			CASE WHEN t.secret != '' THEN 1 ELSE 0 END as is_protected,
 			COUNT(s.id) as subscription_count,
 			t.created_at
 		FROM subscriptions s
@@ -0,0 +1,21 @@
+package fcm
+
+import "os"
+
+// Config holds the tunables for the Firebase Cloud Messaging transport,
+// read from environment variables by LoadConfigFromEnv.
+type Config struct {
+	// CredentialsFile is the path to a Firebase service-account JSON key.
+	// FCM delivery is disabled entirely when this is empty.
+	CredentialsFile string
+}
+
+// Enabled reports whether cfg describes a usable FCM transport.
+func (c Config) Enabled() bool {
+	return c.CredentialsFile != ""
+}
+
+// LoadConfigFromEnv builds a Config from FIREBASE_CREDENTIALS.
+func LoadConfigFromEnv() Config {
+	return Config{CredentialsFile: os.Getenv("FIREBASE_CREDENTIALS")}
+}
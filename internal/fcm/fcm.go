@@ -0,0 +1,104 @@
+// Package fcm delivers notifications to Android/Chrome clients through
+// Firebase Cloud Messaging, as an alternative to the raw web-push protocol
+// internal/webpush speaks. It implements webpush.Transport so
+// Handler.Publish can dispatch to it the same way it dispatches to VAPID
+// subscribers, just keyed off a different subscription type.
+package fcm
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"pushem/internal/metrics"
+	"pushem/internal/webpush"
+
+	firebase "firebase.google.com/go/v4"
+	"firebase.google.com/go/v4/messaging"
+	"google.golang.org/api/option"
+)
+
+// Service delivers notifications via the FCM HTTP v1 API using the
+// official Firebase Admin SDK.
+type Service struct {
+	client *messaging.Client
+}
+
+// NewService builds a Service from cfg. It returns (nil, nil) when cfg is
+// unconfigured, since FCM delivery is optional; callers should treat a nil
+// *Service as "no-op, not configured" rather than an error.
+func NewService(cfg Config) (*Service, error) {
+	if !cfg.Enabled() {
+		return nil, nil
+	}
+
+	ctx := context.Background()
+	app, err := firebase.NewApp(ctx, nil, option.WithCredentialsFile(cfg.CredentialsFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize firebase app: %w", err)
+	}
+
+	client, err := app.Messaging(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize firebase messaging client: %w", err)
+	}
+
+	slog.Info("firebase cloud messaging enabled")
+
+	return &Service{client: client}, nil
+}
+
+// SendNotification implements webpush.Transport, delivering payload to
+// target.Token via FCM. Rich fields (tags, click, icon) are carried both
+// in Data, for clients that render notifications themselves, and in
+// WebpushConfig, for Chrome/PWA clients FCM forwards to via web push.
+func (s *Service) SendNotification(target webpush.Target, payload webpush.NotificationPayload) error {
+	data := map[string]string{}
+	if len(payload.Tags) > 0 {
+		data["tags"] = fmt.Sprint(payload.Tags)
+	}
+	if payload.Priority != 0 {
+		data["priority"] = fmt.Sprint(payload.Priority)
+	}
+	if payload.ClickURL != "" {
+		data["click"] = payload.ClickURL
+	}
+	if payload.Icon != "" {
+		data["icon"] = payload.Icon
+	}
+
+	msg := &messaging.Message{
+		Token: target.Token,
+		Notification: &messaging.Notification{
+			Title: payload.Title,
+			Body:  payload.Message,
+		},
+		Data: data,
+		Webpush: &messaging.WebpushConfig{
+			Notification: &messaging.WebpushNotification{
+				Title: payload.Title,
+				Body:  payload.Message,
+				Icon:  payload.Icon,
+			},
+		},
+	}
+	if payload.ClickURL != "" {
+		msg.Webpush.FCMOptions = &messaging.WebpushFCMOptions{Link: payload.ClickURL}
+	}
+
+	start := time.Now()
+	_, err := s.client.Send(context.Background(), msg)
+	metrics.PushSendDuration.WithLabelValues("fcm").Observe(time.Since(start).Seconds())
+	if err != nil {
+		if messaging.IsUnregistered(err) || messaging.IsInvalidArgument(err) {
+			metrics.PushSendTotal.WithLabelValues("fcm", "expired").Inc()
+			return fmt.Errorf("%w: %v", webpush.ErrSubscriptionExpired, err)
+		}
+		metrics.PushSendTotal.WithLabelValues("fcm", "error").Inc()
+		return fmt.Errorf("failed to send fcm notification: %w", err)
+	}
+
+	metrics.PushSendTotal.WithLabelValues("fcm", "success").Inc()
+	return nil
+}
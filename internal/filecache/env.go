@@ -0,0 +1,64 @@
+package filecache
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+)
+
+// defaultMaxBytes is the local cache's size cap when
+// ATTACHMENT_CACHE_MAX_BYTES is unset.
+const defaultMaxBytes = 5 * 1024 * 1024 * 1024 // 5 GiB
+
+// NewFromEnv builds the attachment Cache described by environment
+// variables, or returns (nil, nil) if attachments are not configured.
+//
+// Local filesystem (used once ATTACHMENT_CACHE_DIR is set):
+//
+//	ATTACHMENT_CACHE_DIR        directory to store attachments in
+//	ATTACHMENT_CACHE_MAX_BYTES  total size cap before LRU eviction kicks in
+//
+// S3-compatible (used instead when ATTACHMENT_S3_BUCKET is set):
+//
+//	ATTACHMENT_S3_ENDPOINT, ATTACHMENT_S3_BUCKET, ATTACHMENT_S3_ACCESS_KEY,
+//	ATTACHMENT_S3_SECRET_KEY, ATTACHMENT_S3_USE_SSL (default "true")
+func NewFromEnv() (Cache, error) {
+	if bucket := os.Getenv("ATTACHMENT_S3_BUCKET"); bucket != "" {
+		useSSL := os.Getenv("ATTACHMENT_S3_USE_SSL") != "false"
+
+		cache, err := NewS3Cache(
+			os.Getenv("ATTACHMENT_S3_ENDPOINT"),
+			os.Getenv("ATTACHMENT_S3_ACCESS_KEY"),
+			os.Getenv("ATTACHMENT_S3_SECRET_KEY"),
+			bucket,
+			useSSL,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize s3 attachment cache: %w", err)
+		}
+
+		slog.Info("attachment cache backend: s3", "bucket", bucket, "endpoint", os.Getenv("ATTACHMENT_S3_ENDPOINT"))
+		return cache, nil
+	}
+
+	dir := os.Getenv("ATTACHMENT_CACHE_DIR")
+	if dir == "" {
+		return nil, nil
+	}
+
+	maxBytes := int64(defaultMaxBytes)
+	if v := os.Getenv("ATTACHMENT_CACHE_MAX_BYTES"); v != "" {
+		if parsed, err := strconv.ParseInt(v, 10, 64); err == nil && parsed > 0 {
+			maxBytes = parsed
+		}
+	}
+
+	cache, err := NewLocalCache(dir, maxBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize local attachment cache: %w", err)
+	}
+
+	slog.Info("attachment cache backend: local filesystem", "dir", dir, "max_bytes", maxBytes)
+	return cache, nil
+}
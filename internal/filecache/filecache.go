@@ -0,0 +1,41 @@
+// Package filecache stores notification attachments behind a small,
+// pluggable interface so the backing store can be local disk or
+// S3-compatible object storage, mirroring ntfy's attachment cache.
+package filecache
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// Attachment describes a stored file and the metadata served back to
+// clients alongside the notification that references it.
+type Attachment struct {
+	ID          string
+	Name        string
+	ContentType string
+	Size        int64
+	ExpiresAt   time.Time
+}
+
+// Cache stores and retrieves attachment bodies. Implementations own
+// their own size accounting and expiry bookkeeping; Sweep is called
+// periodically by the server's cleanup goroutine to reclaim space from
+// attachments whose notifications have expired.
+type Cache interface {
+	// Put stores r under a new attachment id and returns its metadata.
+	Put(ctx context.Context, name, contentType string, expiresAt time.Time, r io.Reader) (Attachment, error)
+
+	// Open returns the body and metadata for a previously stored
+	// attachment.
+	Open(ctx context.Context, id string) (io.ReadCloser, Attachment, error)
+
+	// Delete removes a stored attachment. Deleting an id that doesn't
+	// exist is not an error.
+	Delete(ctx context.Context, id string) error
+
+	// Sweep deletes every attachment that expired before now and
+	// reports how many were removed.
+	Sweep(ctx context.Context, now time.Time) (int, error)
+}
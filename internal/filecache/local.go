@@ -0,0 +1,253 @@
+package filecache
+
+import (
+	"container/list"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LocalCache stores attachments as plain files on disk, evicting the
+// least-recently-used attachment once the total stored size exceeds
+// maxBytes. Each attachment is a pair of files: "<id>.bin" for the body
+// and "<id>.meta" for its JSON-encoded Attachment metadata.
+type LocalCache struct {
+	dir      string
+	maxBytes int64
+
+	mu       sync.Mutex
+	size     int64
+	order    *list.List               // front = most recently used
+	elements map[string]*list.Element // id -> its node in order
+}
+
+// NewLocalCache opens (creating if needed) dir as the backing store for
+// a LocalCache capped at maxBytes total bytes. It rebuilds its LRU index
+// from whatever attachments already exist on disk, ordered oldest-first
+// by file modification time.
+func NewLocalCache(dir string, maxBytes int64) (*LocalCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create attachment dir: %w", err)
+	}
+
+	c := &LocalCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		order:    list.New(),
+		elements: make(map[string]*list.Element),
+	}
+
+	if err := c.loadIndex(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *LocalCache) metaPath(id string) string {
+	return filepath.Join(c.dir, id+".meta")
+}
+
+func (c *LocalCache) blobPath(id string) string {
+	return filepath.Join(c.dir, id+".bin")
+}
+
+func (c *LocalCache) loadIndex() error {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read attachment dir: %w", err)
+	}
+
+	type found struct {
+		meta    Attachment
+		modTime time.Time
+	}
+	var attachments []found
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".meta" {
+			continue
+		}
+
+		meta, err := c.readMeta(strings.TrimSuffix(entry.Name(), ".meta"))
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		attachments = append(attachments, found{meta: meta, modTime: info.ModTime()})
+	}
+
+	sort.Slice(attachments, func(i, j int) bool { return attachments[i].modTime.Before(attachments[j].modTime) })
+
+	for _, f := range attachments {
+		elem := c.order.PushFront(f.meta.ID)
+		c.elements[f.meta.ID] = elem
+		c.size += f.meta.Size
+	}
+
+	return nil
+}
+
+func (c *LocalCache) readMeta(id string) (Attachment, error) {
+	data, err := os.ReadFile(c.metaPath(id))
+	if err != nil {
+		return Attachment{}, err
+	}
+	var meta Attachment
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return Attachment{}, err
+	}
+	return meta, nil
+}
+
+func newAttachmentID() (string, error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("failed to generate attachment id: %w", err)
+	}
+	return "a_" + hex.EncodeToString(raw), nil
+}
+
+func (c *LocalCache) Put(ctx context.Context, name, contentType string, expiresAt time.Time, r io.Reader) (Attachment, error) {
+	id, err := newAttachmentID()
+	if err != nil {
+		return Attachment{}, err
+	}
+
+	f, err := os.OpenFile(c.blobPath(id), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return Attachment{}, fmt.Errorf("failed to create attachment file: %w", err)
+	}
+
+	size, copyErr := io.Copy(f, r)
+	closeErr := f.Close()
+	if copyErr != nil || closeErr != nil {
+		os.Remove(c.blobPath(id))
+		if copyErr != nil {
+			return Attachment{}, fmt.Errorf("failed to write attachment: %w", copyErr)
+		}
+		return Attachment{}, fmt.Errorf("failed to close attachment file: %w", closeErr)
+	}
+
+	meta := Attachment{
+		ID:          id,
+		Name:        name,
+		ContentType: contentType,
+		Size:        size,
+		ExpiresAt:   expiresAt,
+	}
+
+	metaBytes, err := json.Marshal(meta)
+	if err != nil {
+		os.Remove(c.blobPath(id))
+		return Attachment{}, fmt.Errorf("failed to marshal attachment metadata: %w", err)
+	}
+	if err := os.WriteFile(c.metaPath(id), metaBytes, 0600); err != nil {
+		os.Remove(c.blobPath(id))
+		return Attachment{}, fmt.Errorf("failed to write attachment metadata: %w", err)
+	}
+
+	c.mu.Lock()
+	elem := c.order.PushFront(id)
+	c.elements[id] = elem
+	c.size += size
+	c.evictLocked()
+	c.mu.Unlock()
+
+	return meta, nil
+}
+
+// evictLocked removes least-recently-used attachments until the cache is
+// back under maxBytes. Callers must hold c.mu.
+func (c *LocalCache) evictLocked() {
+	for c.maxBytes > 0 && c.size > c.maxBytes {
+		oldest := c.order.Back()
+		if oldest == nil {
+			return
+		}
+
+		id := oldest.Value.(string)
+		if meta, err := c.readMeta(id); err == nil {
+			c.size -= meta.Size
+		}
+		os.Remove(c.blobPath(id))
+		os.Remove(c.metaPath(id))
+		c.order.Remove(oldest)
+		delete(c.elements, id)
+	}
+}
+
+func (c *LocalCache) Open(ctx context.Context, id string) (io.ReadCloser, Attachment, error) {
+	meta, err := c.readMeta(id)
+	if err != nil {
+		return nil, Attachment{}, fmt.Errorf("attachment not found: %w", err)
+	}
+
+	f, err := os.Open(c.blobPath(id))
+	if err != nil {
+		return nil, Attachment{}, fmt.Errorf("attachment not found: %w", err)
+	}
+
+	c.mu.Lock()
+	if elem, ok := c.elements[id]; ok {
+		c.order.MoveToFront(elem)
+	}
+	c.mu.Unlock()
+
+	return f, meta, nil
+}
+
+func (c *LocalCache) Delete(ctx context.Context, id string) error {
+	c.mu.Lock()
+	if meta, err := c.readMeta(id); err == nil {
+		c.size -= meta.Size
+	}
+	if elem, ok := c.elements[id]; ok {
+		c.order.Remove(elem)
+		delete(c.elements, id)
+	}
+	c.mu.Unlock()
+
+	os.Remove(c.blobPath(id))
+	os.Remove(c.metaPath(id))
+	return nil
+}
+
+func (c *LocalCache) Sweep(ctx context.Context, now time.Time) (int, error) {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read attachment dir: %w", err)
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".meta" {
+			continue
+		}
+
+		id := strings.TrimSuffix(entry.Name(), ".meta")
+		meta, err := c.readMeta(id)
+		if err != nil {
+			continue
+		}
+		if meta.ExpiresAt.IsZero() || meta.ExpiresAt.After(now) {
+			continue
+		}
+		if err := c.Delete(ctx, id); err == nil {
+			removed++
+		}
+	}
+
+	return removed, nil
+}
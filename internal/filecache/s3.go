@@ -0,0 +1,131 @@
+package filecache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// s3MetaName and s3MetaExpiresAt are the user-metadata keys S3Cache
+// attaches to every object, since S3 has no native "original filename"
+// or "expires at" concept of its own.
+const (
+	s3MetaName      = "Pushem-Name"
+	s3MetaExpiresAt = "Pushem-Expires-At"
+)
+
+// S3Cache stores attachments in an S3-compatible bucket, for deployments
+// that want the attachment store to survive restarts and be shared
+// across replicas.
+type S3Cache struct {
+	client *minio.Client
+	bucket string
+}
+
+// NewS3Cache connects to an S3-compatible endpoint using static
+// credentials. It assumes bucket already exists.
+func NewS3Cache(endpoint, accessKey, secretKey, bucket string, useSSL bool) (*S3Cache, error) {
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(accessKey, secretKey, ""),
+		Secure: useSSL,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create s3 client: %w", err)
+	}
+
+	return &S3Cache{client: client, bucket: bucket}, nil
+}
+
+func (c *S3Cache) Put(ctx context.Context, name, contentType string, expiresAt time.Time, r io.Reader) (Attachment, error) {
+	id, err := newAttachmentID()
+	if err != nil {
+		return Attachment{}, err
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return Attachment{}, fmt.Errorf("failed to read attachment body: %w", err)
+	}
+
+	_, err = c.client.PutObject(ctx, c.bucket, id, bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{
+		ContentType: contentType,
+		UserMetadata: map[string]string{
+			s3MetaName:      name,
+			s3MetaExpiresAt: strconv.FormatInt(expiresAt.Unix(), 10),
+		},
+	})
+	if err != nil {
+		return Attachment{}, fmt.Errorf("failed to upload attachment: %w", err)
+	}
+
+	return Attachment{
+		ID:          id,
+		Name:        name,
+		ContentType: contentType,
+		Size:        int64(len(data)),
+		ExpiresAt:   expiresAt,
+	}, nil
+}
+
+func (c *S3Cache) Open(ctx context.Context, id string) (io.ReadCloser, Attachment, error) {
+	info, err := c.client.StatObject(ctx, c.bucket, id, minio.StatObjectOptions{})
+	if err != nil {
+		return nil, Attachment{}, fmt.Errorf("attachment not found: %w", err)
+	}
+
+	obj, err := c.client.GetObject(ctx, c.bucket, id, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, Attachment{}, fmt.Errorf("failed to open attachment: %w", err)
+	}
+
+	return obj, attachmentFromObjectInfo(id, info), nil
+}
+
+func (c *S3Cache) Delete(ctx context.Context, id string) error {
+	return c.client.RemoveObject(ctx, c.bucket, id, minio.RemoveObjectOptions{})
+}
+
+func (c *S3Cache) Sweep(ctx context.Context, now time.Time) (int, error) {
+	removed := 0
+	for obj := range c.client.ListObjects(ctx, c.bucket, minio.ListObjectsOptions{WithMetadata: true}) {
+		if obj.Err != nil {
+			continue
+		}
+
+		info, err := c.client.StatObject(ctx, c.bucket, obj.Key, minio.StatObjectOptions{})
+		if err != nil {
+			continue
+		}
+
+		meta := attachmentFromObjectInfo(obj.Key, info)
+		if meta.ExpiresAt.IsZero() || meta.ExpiresAt.After(now) {
+			continue
+		}
+		if err := c.Delete(ctx, obj.Key); err == nil {
+			removed++
+		}
+	}
+
+	return removed, nil
+}
+
+func attachmentFromObjectInfo(id string, info minio.ObjectInfo) Attachment {
+	meta := Attachment{
+		ID:          id,
+		Name:        info.UserMetadata[s3MetaName],
+		ContentType: info.ContentType,
+		Size:        info.Size,
+	}
+	if expires := info.UserMetadata[s3MetaExpiresAt]; expires != "" {
+		if unix, err := strconv.ParseInt(expires, 10, 64); err == nil {
+			meta.ExpiresAt = time.Unix(unix, 0)
+		}
+	}
+	return meta
+}
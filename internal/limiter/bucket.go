@@ -0,0 +1,76 @@
+package limiter
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenBucket is a simple token-bucket rate limiter: it holds up to
+// capacity tokens and refills at replenishPerSec tokens per second.
+type tokenBucket struct {
+	mu              sync.Mutex
+	capacity        float64
+	tokens          float64
+	replenishPerSec float64
+	lastRefill      time.Time
+}
+
+func newTokenBucket(capacity, replenishPerSec float64) *tokenBucket {
+	return &tokenBucket{
+		capacity:        capacity,
+		tokens:          capacity,
+		replenishPerSec: replenishPerSec,
+		lastRefill:      time.Now(),
+	}
+}
+
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	elapsed := now.Sub(b.lastRefill).Seconds()
+	b.lastRefill = now
+
+	b.tokens += elapsed * b.replenishPerSec
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+}
+
+// allow attempts to take cost tokens from the bucket. It reports whether
+// the request is allowed and, if not, how long the caller should wait
+// before retrying.
+func (b *tokenBucket) allow(cost float64) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill()
+
+	if b.tokens >= cost {
+		b.tokens -= cost
+		return true, 0
+	}
+
+	deficit := cost - b.tokens
+	retryAfter := time.Duration(deficit/b.replenishPerSec*1000) * time.Millisecond
+	return false, retryAfter
+}
+
+// refund returns cost tokens to the bucket, used when an optimistic
+// charge (e.g. an estimated response size) turned out to be too high.
+func (b *tokenBucket) refund(cost float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens += cost
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+}
+
+// remaining returns the current token count, for reporting quotas to
+// clients.
+func (b *tokenBucket) remaining() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	return b.tokens
+}
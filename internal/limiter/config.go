@@ -0,0 +1,125 @@
+package limiter
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Config holds the tunables for per-visitor rate limiting, all
+// overridable via environment variables so operators can adjust them
+// without a rebuild.
+type Config struct {
+	// RequestBurst/RequestReplenishPerSec bound the overall request rate
+	// of every /{topic} route (subscribe, publish, history, streaming,
+	// attachments), ahead of the more specific buckets below.
+	RequestBurst           float64
+	RequestReplenishPerSec float64
+
+	// PublishBurst/PublishReplenishPerSec bound POST /publish/{topic}.
+	PublishBurst           float64
+	PublishReplenishPerSec float64
+
+	// MessageDailyLimit caps how many messages a visitor may publish per
+	// rolling 24h window, independent of the burst bucket above.
+	MessageDailyLimit int
+
+	// SubscribeBurst/SubscribeReplenishPerSec bound subscription churn on
+	// POST /subscribe/{topic}.
+	SubscribeBurst           float64
+	SubscribeReplenishPerSec float64
+
+	// MaxActiveStreams caps how many concurrent SSE/WebSocket/ndjson
+	// connections a visitor may hold open at once.
+	MaxActiveStreams int
+
+	// HistoryBandwidthBurst/HistoryBandwidthReplenishPerSec bound the
+	// bytes a visitor may read back via GET /history/{topic}.
+	HistoryBandwidthBurst           float64
+	HistoryBandwidthReplenishPerSec float64
+
+	// UploadBandwidthBurst/UploadBandwidthReplenishPerSec bound the
+	// attachment bytes a visitor may upload via PUT /publish/{topic}.
+	UploadBandwidthBurst           float64
+	UploadBandwidthReplenishPerSec float64
+
+	// AttachmentBytesDailyLimit caps the total attachment bytes a visitor
+	// may upload per rolling 24h window, independent of the bandwidth
+	// bucket above (which only throttles burst rate, not cumulative use).
+	AttachmentBytesDailyLimit float64
+
+	// TrustedProxies lists CIDRs allowed to set X-Forwarded-For; requests
+	// from any other peer have that header ignored.
+	TrustedProxies []*net.IPNet
+
+	// IdleVisitorTTL controls how long a visitor can go unseen before its
+	// buckets are garbage collected.
+	IdleVisitorTTL float64 // seconds, kept as float64 to avoid an extra import in callers
+
+	// AdminCheck, if set, is consulted before every limit check; requests
+	// it reports as admin bypass visitor limits entirely, so the user
+	// subsystem's admin role maps onto an unlimited tier. Left nil, no
+	// request is ever exempted.
+	AdminCheck func(*http.Request) bool
+}
+
+func envFloat(name string, def float64) float64 {
+	if v := os.Getenv(name); v != "" {
+		if parsed, err := strconv.ParseFloat(v, 64); err == nil && parsed > 0 {
+			return parsed
+		}
+	}
+	return def
+}
+
+func envInt(name string, def int) int {
+	if v := os.Getenv(name); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
+			return parsed
+		}
+	}
+	return def
+}
+
+func envCIDRList(name string) []*net.IPNet {
+	v := os.Getenv(name)
+	if v == "" {
+		return nil
+	}
+
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(v, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if _, ipnet, err := net.ParseCIDR(entry); err == nil {
+			nets = append(nets, ipnet)
+		}
+	}
+	return nets
+}
+
+// LoadConfigFromEnv builds a Config from environment variables, falling
+// back to sane defaults for anything unset.
+func LoadConfigFromEnv() Config {
+	return Config{
+		RequestBurst:                    envFloat("VISITOR_GENERAL_LIMIT_BURST", 60),
+		RequestReplenishPerSec:          envFloat("VISITOR_GENERAL_LIMIT_REPLENISH", 1),
+		PublishBurst:                    envFloat("VISITOR_REQUEST_LIMIT_BURST", 10),
+		PublishReplenishPerSec:          envFloat("VISITOR_REQUEST_LIMIT_REPLENISH", 1),
+		MessageDailyLimit:               envInt("VISITOR_MESSAGE_DAILY_LIMIT", 1000),
+		SubscribeBurst:                  envFloat("VISITOR_SUBSCRIBE_LIMIT_BURST", 5),
+		SubscribeReplenishPerSec:        envFloat("VISITOR_SUBSCRIBE_LIMIT_REPLENISH", 0.1),
+		MaxActiveStreams:                envInt("VISITOR_MAX_ACTIVE_STREAMS", 30),
+		HistoryBandwidthBurst:           envFloat("VISITOR_HISTORY_BANDWIDTH_BURST_BYTES", 10*1024*1024),
+		HistoryBandwidthReplenishPerSec: envFloat("VISITOR_HISTORY_BANDWIDTH_REPLENISH_BYTES", 1024*1024),
+		UploadBandwidthBurst:            envFloat("VISITOR_UPLOAD_BANDWIDTH_BURST_BYTES", 200*1024*1024),
+		UploadBandwidthReplenishPerSec:  envFloat("VISITOR_UPLOAD_BANDWIDTH_REPLENISH_BYTES", 20*1024*1024),
+		AttachmentBytesDailyLimit:       envFloat("VISITOR_ATTACHMENT_BYTES_DAILY_LIMIT", 500*1024*1024),
+		TrustedProxies:                  envCIDRList("TRUSTED_PROXY_CIDRS"),
+		IdleVisitorTTL:                  envFloat("VISITOR_IDLE_TTL_SECONDS", 3600),
+	}
+}
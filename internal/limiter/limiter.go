@@ -0,0 +1,294 @@
+// Package limiter installs chi middleware that enforces per-visitor
+// token-bucket rate limits and quotas, modeled on ntfy's visitor concept:
+// every caller (an authenticated token or, failing that, an IP address)
+// gets its own request/publish/subscribe/history/upload buckets, a daily
+// message cap, a daily attachment-bytes cap, and a concurrent-stream cap,
+// so one noisy visitor can't starve the rest. Admins, once the user
+// subsystem identifies them via Config.AdminCheck, bypass every limit.
+package limiter
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const reapInterval = 10 * time.Minute
+
+// Limiter tracks one visitor per caller identity and enforces Config's
+// limits against it via chi middleware.
+type Limiter struct {
+	cfg Config
+
+	mu       sync.Mutex
+	visitors map[string]*visitor
+}
+
+// New creates a Limiter configured by cfg and starts its background
+// reaper that prunes visitors idle longer than cfg.IdleVisitorTTL.
+func New(cfg Config) *Limiter {
+	l := &Limiter{
+		cfg:      cfg,
+		visitors: make(map[string]*visitor),
+	}
+	go l.reapLoop()
+	return l
+}
+
+func (l *Limiter) reapLoop() {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+
+	ttl := time.Duration(l.cfg.IdleVisitorTTL) * time.Second
+	for range ticker.C {
+		l.mu.Lock()
+		for key, v := range l.visitors {
+			if v.idleSince() > ttl {
+				delete(l.visitors, key)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// visitorFor returns the visitor for r, creating one if this is its
+// first request.
+func (l *Limiter) visitorFor(r *http.Request) *visitor {
+	key := visitorKey(r, l.cfg.TrustedProxies)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	v, ok := l.visitors[key]
+	if !ok {
+		v = newVisitor(l.cfg)
+		l.visitors[key] = v
+	}
+	return v
+}
+
+func tooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	if retryAfter < time.Second {
+		retryAfter = time.Second
+	}
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", int(retryAfter.Seconds())))
+	http.Error(w, "rate limit exceeded, retry later", http.StatusTooManyRequests)
+}
+
+// privileged reports whether r belongs to an admin, who is exempt from
+// every visitor limit below.
+func (l *Limiter) privileged(r *http.Request) bool {
+	return l.cfg.AdminCheck != nil && l.cfg.AdminCheck(r)
+}
+
+// RequestLimit enforces the per-visitor overall request rate around every
+// /{topic} route, ahead of the more specific limits below.
+func (l *Limiter) RequestLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l.privileged(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		v := l.visitorFor(r)
+		v.touch()
+
+		if ok, retryAfter := v.request.allow(1); !ok {
+			tooManyRequests(w, retryAfter)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// PublishLimit enforces the per-visitor publish rate and daily message
+// quota around POST /publish/{topic}.
+func (l *Limiter) PublishLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l.privileged(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		v := l.visitorFor(r)
+		v.touch()
+
+		if ok, retryAfter := v.publish.allow(1); !ok {
+			tooManyRequests(w, retryAfter)
+			return
+		}
+
+		if !v.allowDaily(l.cfg.MessageDailyLimit) {
+			tooManyRequests(w, time.Hour)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// SubscribeLimit enforces the per-visitor subscription churn rate around
+// POST /subscribe/{topic}.
+func (l *Limiter) SubscribeLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l.privileged(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		v := l.visitorFor(r)
+		v.touch()
+
+		if ok, retryAfter := v.subscribe.allow(1); !ok {
+			tooManyRequests(w, retryAfter)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// StreamLimit enforces a per-visitor cap on concurrent streaming
+// connections (WebSocket, SSE, ndjson) around the handler's lifetime,
+// since those handlers block for as long as the connection stays open.
+func (l *Limiter) StreamLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l.privileged(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		v := l.visitorFor(r)
+		v.touch()
+
+		if !v.acquireStream(l.cfg.MaxActiveStreams) {
+			tooManyRequests(w, time.Minute)
+			return
+		}
+		defer v.releaseStream()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// historyResponseCost is the token cost charged up-front against the
+// history bandwidth bucket; the surplus is refunded once the true
+// response size is known.
+const historyResponseCost = 4096
+
+// HistoryLimit enforces a per-visitor bandwidth budget around
+// GET /history/{topic}: it charges historyResponseCost up front and
+// refunds whatever part of it the response did not write. Bytes written
+// beyond historyResponseCost are not charged.
+func (l *Limiter) HistoryLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l.privileged(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		v := l.visitorFor(r)
+		v.touch()
+
+		if ok, retryAfter := v.history.allow(historyResponseCost); !ok {
+			tooManyRequests(w, retryAfter)
+			return
+		}
+
+		counting := &byteCountingWriter{ResponseWriter: w}
+		next.ServeHTTP(counting, r)
+
+		if counting.written < historyResponseCost {
+			v.history.refund(historyResponseCost - float64(counting.written))
+		}
+	})
+}
+
+// defaultUploadCost is charged against the upload bandwidth bucket when a
+// request arrives without a Content-Length, since we can't know its size
+// up front.
+const defaultUploadCost = 1024 * 1024
+
+// UploadLimit enforces a per-visitor bandwidth budget and cumulative
+// daily attachment-bytes cap around PUT /publish/{topic}, charging both
+// for the declared attachment size before the body is read.
+func (l *Limiter) UploadLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l.privileged(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		v := l.visitorFor(r)
+		v.touch()
+
+		cost := float64(defaultUploadCost)
+		if r.ContentLength > 0 {
+			cost = float64(r.ContentLength)
+		}
+
+		if ok, retryAfter := v.upload.allow(cost); !ok {
+			tooManyRequests(w, retryAfter)
+			return
+		}
+
+		if !v.allowAttachmentBytes(l.cfg.AttachmentBytesDailyLimit, cost) {
+			tooManyRequests(w, time.Hour)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// byteCountingWriter wraps http.ResponseWriter to measure how many bytes
+// a handler actually wrote, so bandwidth can be metered accurately.
+type byteCountingWriter struct {
+	http.ResponseWriter
+	written int64
+}
+
+func (w *byteCountingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// accountResponse is the JSON body returned by the /v1/account endpoint.
+type accountResponse struct {
+	PublishRemaining   float64 `json:"publish_remaining"`
+	SubscribeRemaining float64 `json:"subscribe_remaining"`
+	MessagesUsedToday  int     `json:"messages_used_today"`
+	MessageDailyLimit  int     `json:"message_daily_limit"`
+}
+
+// VisitorCount returns the number of visitors currently tracked, for the
+// metrics collector to report as a gauge. It includes idle visitors not
+// yet pruned by the reaper, so it's an upper bound on the number actually
+// active at any instant.
+func (l *Limiter) VisitorCount() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.visitors)
+}
+
+// AccountHandler reports the caller's remaining quota, so clients can
+// back off before hitting a 429.
+func (l *Limiter) AccountHandler(w http.ResponseWriter, r *http.Request) {
+	v := l.visitorFor(r)
+
+	v.mu.Lock()
+	used := v.dailyCount
+	v.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(accountResponse{
+		PublishRemaining:   v.publish.remaining(),
+		SubscribeRemaining: v.subscribe.remaining(),
+		MessagesUsedToday:  used,
+		MessageDailyLimit:  l.cfg.MessageDailyLimit,
+	})
+}
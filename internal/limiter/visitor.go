@@ -0,0 +1,162 @@
+package limiter
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// visitor tracks the independent rate-limit buckets for a single caller,
+// identified either by authenticated user/token or by IP address.
+type visitor struct {
+	request   *tokenBucket
+	publish   *tokenBucket
+	subscribe *tokenBucket
+	history   *tokenBucket
+	upload    *tokenBucket
+
+	mu                  sync.Mutex
+	dailyCount          int
+	attachmentBytesUsed float64
+	dailyWindowStart    time.Time
+	activeStreams       int
+	lastSeen            time.Time
+}
+
+func newVisitor(cfg Config) *visitor {
+	now := time.Now()
+	return &visitor{
+		request:          newTokenBucket(cfg.RequestBurst, cfg.RequestReplenishPerSec),
+		publish:          newTokenBucket(cfg.PublishBurst, cfg.PublishReplenishPerSec),
+		subscribe:        newTokenBucket(cfg.SubscribeBurst, cfg.SubscribeReplenishPerSec),
+		history:          newTokenBucket(cfg.HistoryBandwidthBurst, cfg.HistoryBandwidthReplenishPerSec),
+		upload:           newTokenBucket(cfg.UploadBandwidthBurst, cfg.UploadBandwidthReplenishPerSec),
+		dailyWindowStart: now,
+		lastSeen:         now,
+	}
+}
+
+// touch marks the visitor as recently active, for idle GC.
+func (v *visitor) touch() {
+	v.mu.Lock()
+	v.lastSeen = time.Now()
+	v.mu.Unlock()
+}
+
+// resetDailyWindowIfNeeded clears the rolling-24h counters once the
+// window has elapsed. Callers must hold v.mu.
+func (v *visitor) resetDailyWindowIfNeeded() {
+	if time.Since(v.dailyWindowStart) > 24*time.Hour {
+		v.dailyCount = 0
+		v.attachmentBytesUsed = 0
+		v.dailyWindowStart = time.Now()
+	}
+}
+
+// allowDaily reports whether the visitor is still within its daily
+// message quota, incrementing the counter if so.
+func (v *visitor) allowDaily(limit int) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.resetDailyWindowIfNeeded()
+
+	if v.dailyCount >= limit {
+		return false
+	}
+	v.dailyCount++
+	return true
+}
+
+// allowAttachmentBytes reports whether adding size bytes keeps the
+// visitor within its daily attachment-bytes quota, charging it if so.
+func (v *visitor) allowAttachmentBytes(limit, size float64) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.resetDailyWindowIfNeeded()
+
+	if v.attachmentBytesUsed+size > limit {
+		return false
+	}
+	v.attachmentBytesUsed += size
+	return true
+}
+
+// acquireStream reserves one of the visitor's max concurrent streaming
+// connection slots, reporting whether one was available.
+func (v *visitor) acquireStream(max int) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.activeStreams >= max {
+		return false
+	}
+	v.activeStreams++
+	return true
+}
+
+// releaseStream frees a streaming connection slot acquired by acquireStream.
+func (v *visitor) releaseStream() {
+	v.mu.Lock()
+	v.activeStreams--
+	v.mu.Unlock()
+}
+
+func (v *visitor) idleSince() time.Duration {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return time.Since(v.lastSeen)
+}
+
+// visitorKey resolves r to a stable identity: "user:<token>" when a
+// bearer token is present (the token is not validated here), otherwise
+// "ip:<addr>".
+func visitorKey(r *http.Request, trustedProxies []*net.IPNet) string {
+	if token := bearerToken(r); token != "" {
+		return "user:" + token
+	}
+	return "ip:" + clientIP(r, trustedProxies)
+}
+
+func bearerToken(r *http.Request) string {
+	const prefix = "Bearer "
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, prefix) {
+		return ""
+	}
+	return strings.TrimPrefix(header, prefix)
+}
+
+// clientIP resolves the real client address, only trusting
+// X-Forwarded-For when RemoteAddr belongs to a configured trusted proxy.
+func clientIP(r *http.Request, trustedProxies []*net.IPNet) string {
+	remoteIP := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(remoteIP); err == nil {
+		remoteIP = host
+	}
+
+	if isTrustedProxy(remoteIP, trustedProxies) {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			parts := strings.Split(forwarded, ",")
+			return strings.TrimSpace(parts[0])
+		}
+	}
+
+	return remoteIP
+}
+
+func isTrustedProxy(ipStr string, trustedProxies []*net.IPNet) bool {
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
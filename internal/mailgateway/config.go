@@ -0,0 +1,84 @@
+package mailgateway
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Config holds the tunables for the inbound SMTP gateway, read from
+// environment variables by LoadConfigFromEnv.
+type Config struct {
+	// ListenAddr is the address the SMTP listener binds to, e.g. ":2525".
+	// The gateway is disabled entirely when this is empty.
+	ListenAddr string
+
+	// MaxMessageBytes caps the size of an inbound message, including
+	// headers.
+	MaxMessageBytes int64
+
+	// TLSCertFile/TLSKeyFile enable STARTTLS; both must be set together.
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// AllowedSenderDomains restricts MAIL FROM to these domains (matched
+	// case-insensitively against the part after "@"). An empty list
+	// allows any sender.
+	AllowedSenderDomains []string
+}
+
+// Enabled reports whether cfg describes a gateway that should actually
+// listen, rather than being left off by default.
+func (c Config) Enabled() bool {
+	return c.ListenAddr != ""
+}
+
+// LoadConfigFromEnv builds a Config from SMTP_LISTEN_ADDR,
+// SMTP_MAX_MESSAGE_BYTES, SMTP_TLS_CERT_FILE, SMTP_TLS_KEY_FILE, and
+// SMTP_ALLOWED_SENDER_DOMAINS.
+func LoadConfigFromEnv() Config {
+	maxBytes := int64(10 * 1024 * 1024)
+	if raw := os.Getenv("SMTP_MAX_MESSAGE_BYTES"); raw != "" {
+		if parsed, err := strconv.ParseInt(raw, 10, 64); err == nil && parsed > 0 {
+			maxBytes = parsed
+		}
+	}
+
+	var domains []string
+	if raw := os.Getenv("SMTP_ALLOWED_SENDER_DOMAINS"); raw != "" {
+		for _, domain := range strings.Split(raw, ",") {
+			if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+				domains = append(domains, domain)
+			}
+		}
+	}
+
+	return Config{
+		ListenAddr:           os.Getenv("SMTP_LISTEN_ADDR"),
+		MaxMessageBytes:      maxBytes,
+		TLSCertFile:          os.Getenv("SMTP_TLS_CERT_FILE"),
+		TLSKeyFile:           os.Getenv("SMTP_TLS_KEY_FILE"),
+		AllowedSenderDomains: domains,
+	}
+}
+
+// senderDomainAllowed reports whether from's domain is permitted by
+// domains. An empty domains list permits any sender.
+func senderDomainAllowed(from string, domains []string) bool {
+	if len(domains) == 0 {
+		return true
+	}
+
+	_, domain, ok := strings.Cut(from, "@")
+	if !ok {
+		return false
+	}
+	domain = strings.ToLower(domain)
+
+	for _, allowed := range domains {
+		if domain == allowed {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,215 @@
+// Package mailgateway runs an embedded SMTP server that turns inbound mail
+// into Publish calls, so alerting systems that only speak SMTP (Grafana,
+// Zabbix, Prometheus Alertmanager's email receiver) can push through
+// pushem without a code change on their side. The recipient's local-part
+// becomes the topic (e.g. alerts@push.example.com -> topic "alerts"), the
+// Subject header becomes the notification title, and the text/plain body
+// becomes the message.
+package mailgateway
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"strings"
+
+	"pushem/internal/validation"
+
+	"github.com/emersion/go-smtp"
+	"github.com/go-chi/chi/v5"
+)
+
+// PublishFunc matches Handler.Publish's signature, so the gateway can
+// replay a translated email through the exact same fan-out path an HTTP
+// publish request takes (auth check, history, stream fan-out, web push).
+type PublishFunc func(w http.ResponseWriter, r *http.Request)
+
+// Gateway listens for inbound SMTP mail and republishes each message as
+// described in the package doc comment.
+type Gateway struct {
+	cfg     Config
+	publish PublishFunc
+	server  *smtp.Server
+}
+
+// New builds a Gateway from cfg; it does not start listening until
+// ListenAndServe is called.
+func New(cfg Config, publish PublishFunc) *Gateway {
+	g := &Gateway{cfg: cfg, publish: publish}
+
+	g.server = smtp.NewServer(&backend{gateway: g})
+	g.server.Addr = cfg.ListenAddr
+	g.server.Domain = "pushem"
+	g.server.MaxMessageBytes = cfg.MaxMessageBytes
+	g.server.MaxRecipients = 1
+	g.server.AllowInsecureAuth = true
+
+	if cfg.TLSCertFile != "" && cfg.TLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err == nil {
+			g.server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		} else {
+			slog.Error("failed to load SMTP STARTTLS certificate, continuing without TLS", "error", err)
+		}
+	}
+
+	return g
+}
+
+// ListenAndServe starts the SMTP listener and blocks until it stops.
+func (g *Gateway) ListenAndServe() error {
+	slog.Info("SMTP gateway listening", "addr", g.cfg.ListenAddr)
+	return g.server.ListenAndServe()
+}
+
+// backend implements smtp.Backend, handing out one session per connection.
+type backend struct {
+	gateway *Gateway
+}
+
+func (b *backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &session{gateway: b.gateway}, nil
+}
+
+// session implements smtp.Session for a single SMTP transaction: exactly
+// one sender, one recipient (MaxRecipients is 1), and one DATA command.
+type session struct {
+	gateway *Gateway
+	topic   string
+}
+
+func (s *session) Mail(from string, opts *smtp.MailOptions) error {
+	if !senderDomainAllowed(from, s.gateway.cfg.AllowedSenderDomains) {
+		return &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "sender domain not allowed"}
+	}
+	return nil
+}
+
+func (s *session) Rcpt(to string, opts *smtp.RcptOptions) error {
+	topic, _, ok := strings.Cut(to, "@")
+	if !ok {
+		topic = to
+	}
+	if err := validation.ValidateTopic(topic); err != nil {
+		return &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "recipient does not map to a valid topic"}
+	}
+	s.topic = topic
+	return nil
+}
+
+func (s *session) Data(r io.Reader) error {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return &smtp.SMTPError{Code: 554, EnhancedCode: smtp.EnhancedCode{5, 6, 0}, Message: "malformed message"}
+	}
+
+	title := validation.SanitizeString(msg.Header.Get("Subject"))
+	body, err := plainTextBody(msg)
+	if err != nil {
+		return &smtp.SMTPError{Code: 554, EnhancedCode: smtp.EnhancedCode{5, 6, 0}, Message: "could not extract message body"}
+	}
+
+	payload, err := json.Marshal(map[string]string{"title": title, "message": body})
+	if err != nil {
+		return &smtp.SMTPError{Code: 554, EnhancedCode: smtp.EnhancedCode{5, 6, 0}, Message: "could not encode message"}
+	}
+	req := httptest.NewRequest(http.MethodPost, "/publish/"+s.topic, bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	if key := msg.Header.Get("X-Pushem-Key"); key != "" {
+		req.Header.Set("X-Pushem-Key", key)
+	}
+	req = withTopicParam(req, s.topic)
+
+	rec := httptest.NewRecorder()
+	s.gateway.publish(rec, req)
+
+	if rec.Code >= 400 {
+		slog.Warn("mail publish rejected", "topic", s.topic, "status", rec.Code, "body", rec.Body.String())
+		return &smtp.SMTPError{Code: 554, EnhancedCode: smtp.EnhancedCode{5, 6, 0}, Message: "publish rejected: " + strings.TrimSpace(rec.Body.String())}
+	}
+
+	slog.Info("published mail to topic", "topic", s.topic, "title", title)
+	return nil
+}
+
+// withTopicParam attaches a chi route context to req carrying topic as
+// the {topic} URL param, so Handler.Publish's chi.URLParam(r, "topic")
+// call resolves exactly as it would for a real HTTP request.
+func withTopicParam(req *http.Request, topic string) *http.Request {
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("topic", topic)
+	return req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, rctx))
+}
+
+func (s *session) Reset() {}
+
+func (s *session) Logout() error {
+	return nil
+}
+
+// plainTextBody extracts the text/plain part of msg, decoding a
+// quoted-printable or base64 Content-Transfer-Encoding and, for a
+// multipart message, walking parts until the first text/plain one.
+func plainTextBody(msg *mail.Message) (string, error) {
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		// No (or unparsable) Content-Type: treat the whole body as plain text.
+		return decodeBody(msg.Body, msg.Header.Get("Content-Transfer-Encoding"))
+	}
+
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		return decodeBody(msg.Body, msg.Header.Get("Content-Transfer-Encoding"))
+	}
+
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return "", fmt.Errorf("no text/plain part found")
+		}
+		if err != nil {
+			return "", err
+		}
+
+		partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if partType == "" || partType == "text/plain" {
+			return decodeBody(part, part.Header.Get("Content-Transfer-Encoding"))
+		}
+	}
+}
+
+func decodeBody(r io.Reader, transferEncoding string) (string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+
+	switch strings.ToLower(strings.TrimSpace(transferEncoding)) {
+	case "quoted-printable":
+		decoded, err := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(data)))
+		if err != nil {
+			return "", err
+		}
+		data = decoded
+	case "base64":
+		// Mail clients wrap base64 bodies across lines; strip them before
+		// decoding since base64.Encoding rejects embedded newlines.
+		cleaned := strings.NewReplacer("\r", "", "\n", "").Replace(string(data))
+		if decoded, err := base64.StdEncoding.DecodeString(cleaned); err == nil {
+			data = decoded
+		}
+	}
+
+	return validation.SanitizeString(string(data)), nil
+}
@@ -0,0 +1,42 @@
+package metrics
+
+import (
+	"log/slog"
+	"time"
+
+	"pushem/internal/db"
+	"pushem/internal/stream"
+)
+
+// StartCollector periodically refreshes the Topics, Subscriptions,
+// LiveStreamSubscribers, and RateLimitedVisitors gauges from database,
+// hub, and visitorCount, blocking forever. It's meant to be run in its
+// own goroutine; it logs and skips a tick rather than failing outright if
+// database reads fail.
+func StartCollector(database *db.DB, hub *stream.Hub, visitorCount func() int, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	collect(database, hub, visitorCount)
+	for range ticker.C {
+		collect(database, hub, visitorCount)
+	}
+}
+
+func collect(database *db.DB, hub *stream.Hub, visitorCount func() int) {
+	topics, err := database.ListAllTopics()
+	if err != nil {
+		slog.Error("metrics collector: failed to list topics", "error", err)
+	} else {
+		Topics.Set(float64(len(topics)))
+		for _, topic := range topics {
+			Subscriptions.WithLabelValues(topic.Name).Set(float64(topic.SubscriptionCount))
+		}
+	}
+
+	for _, count := range hub.LiveSubscriberCounts() {
+		LiveStreamSubscribers.WithLabelValues(count.Topic, count.Transport).Set(float64(count.Count))
+	}
+
+	RateLimitedVisitors.Set(float64(visitorCount()))
+}
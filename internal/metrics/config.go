@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Config holds the tunables for guarding the /metrics endpoint.
+type Config struct {
+	// AllowedCIDRs, if non-empty, restricts /metrics to callers whose
+	// RemoteAddr falls inside one of these networks; anyone else gets a
+	// 403. Left empty, /metrics is open to anyone who can reach the
+	// listener, so operators relying on the separate-listener mode should
+	// bind it to a private interface themselves.
+	AllowedCIDRs []*net.IPNet
+}
+
+func envCIDRList(name string) []*net.IPNet {
+	v := os.Getenv(name)
+	if v == "" {
+		return nil
+	}
+
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(v, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if _, ipnet, err := net.ParseCIDR(entry); err == nil {
+			nets = append(nets, ipnet)
+		}
+	}
+	return nets
+}
+
+// LoadConfigFromEnv builds a Config from METRICS_ALLOWED_CIDRS, a
+// comma-separated CIDR list.
+func LoadConfigFromEnv() Config {
+	return Config{
+		AllowedCIDRs: envCIDRList("METRICS_ALLOWED_CIDRS"),
+	}
+}
+
+// allowListMiddleware rejects requests whose RemoteAddr isn't inside one
+// of cfg.AllowedCIDRs. If cfg.AllowedCIDRs is empty, every request passes
+// through unchecked.
+func (cfg Config) allowListMiddleware(next http.Handler) http.Handler {
+	if len(cfg.AllowedCIDRs) == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remoteIP := r.RemoteAddr
+		if host, _, err := net.SplitHostPort(remoteIP); err == nil {
+			remoteIP = host
+		}
+
+		ip := net.ParseIP(remoteIP)
+		if ip == nil {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		for _, network := range cfg.AllowedCIDRs {
+			if network.Contains(ip) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		http.Error(w, "forbidden", http.StatusForbidden)
+	})
+}
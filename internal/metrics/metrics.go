@@ -0,0 +1,140 @@
+// Package metrics registers the Prometheus collectors pushem exposes
+// about message throughput, push delivery, and HTTP traffic, and serves
+// them on their own listener so operators can firewall /metrics off from
+// the public API (the same separation ntfy and crowdsec use).
+package metrics
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	MessagesPublishedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pushem_messages_published_total",
+		Help: "Total number of messages published, by topic.",
+	}, []string{"topic"})
+
+	PushSendDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "pushem_push_send_duration_seconds",
+		Help:    "Time taken to deliver a push notification to a single subscription.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"transport"})
+
+	PushSendTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pushem_push_send_total",
+		Help: "Total number of push delivery attempts, by transport and result.",
+	}, []string{"transport", "result"})
+
+	PublishFanoutDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "pushem_publish_fanout_duration_seconds",
+		Help:    "Time taken to dispatch a published message to every subscriber of its topic.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	AdminLoginTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pushem_admin_login_total",
+		Help: "Total number of admin login attempts, by result.",
+	}, []string{"result"})
+
+	ActiveSubscriptions = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "pushem_active_subscriptions",
+		Help: "Subscriptions registered (web push, FCM, and callback) minus those removed as expired, counted since this process started.",
+	})
+
+	VAPIDTokenGenerationsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pushem_vapid_token_generations_total",
+		Help: "Total number of VAPID JWTs generated for outbound push delivery.",
+	})
+
+	HTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "pushem_http_request_duration_seconds",
+		Help:    "HTTP request latency by route and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "code"})
+
+	HTTPRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pushem_http_requests_total",
+		Help: "Total number of HTTP requests, by route and status code.",
+	}, []string{"route", "code"})
+
+	Topics = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "pushem_topics",
+		Help: "Current number of topics with at least one stored subscription.",
+	})
+
+	Subscriptions = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pushem_subscriptions",
+		Help: "Current number of stored subscriptions, by topic.",
+	}, []string{"topic"})
+
+	LiveStreamSubscribers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "pushem_live_stream_subscribers",
+		Help: "Current number of live stream listeners, by topic and transport (sse, ws, json).",
+	}, []string{"topic", "transport"})
+
+	// RateLimitedVisitors is an approximation: it counts every visitor the
+	// limiter is currently tracking, not only ones actively being
+	// throttled, since the limiter doesn't distinguish the two.
+	RateLimitedVisitors = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "pushem_rate_limited_visitors",
+		Help: "Current number of visitors tracked by the per-visitor rate limiter.",
+	})
+)
+
+// Handler returns the promhttp handler to mount at /metrics.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// ListenAndServe starts a dedicated metrics listener on addr, separate
+// from the main API router, so it can be bound to a private interface or
+// firewalled off entirely. If cfg has allowed CIDRs configured, requests
+// from outside them are rejected; an empty allow-list permits anyone who
+// can reach addr, so operators relying on this mode should bind addr to a
+// private interface themselves. It blocks and should be run in its own
+// goroutine; it logs and returns if the listener fails to start.
+func ListenAndServe(addr string, cfg Config) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", cfg.allowListMiddleware(Handler()))
+
+	slog.Info("metrics listener starting", "addr", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		slog.Error("metrics listener failed", "addr", addr, "error", err)
+	}
+}
+
+// Middleware wraps an http.Handler to record HTTPRequestDuration and
+// HTTPRequestsTotal for every request, labeled by the matched chi route
+// pattern.
+func Middleware(routePattern func(*http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+			next.ServeHTTP(rec, r)
+
+			route := routePattern(r)
+			code := strconv.Itoa(rec.status)
+			HTTPRequestDuration.WithLabelValues(route, code).Observe(time.Since(start).Seconds())
+			HTTPRequestsTotal.WithLabelValues(route, code).Inc()
+		})
+	}
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,311 @@
+package stream
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"pushem/internal/db"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
+)
+
+// sqliteTimeLayout matches the format SQLite's CURRENT_TIMESTAMP writes
+// into the messages table.
+const sqliteTimeLayout = "2006-01-02 15:04:05"
+
+// Handler serves the live-streaming endpoints (WebSocket and SSE) backed
+// by a Hub for fan-out and db.DB for history replay.
+type Handler struct {
+	hub       *Hub
+	db        *db.DB
+	checkAuth AuthChecker
+}
+
+// AuthChecker authorizes access to a topic the same way the main API
+// handler does, so streaming endpoints honor topic protection. It writes
+// an error response and returns false when access is denied.
+type AuthChecker func(w http.ResponseWriter, r *http.Request, topic string) bool
+
+// NewHandler creates a streaming Handler backed by hub and database,
+// reusing checkAuth for topic protection.
+func NewHandler(hub *Hub, database *db.DB, checkAuth AuthChecker) *Handler {
+	return &Handler{hub: hub, db: database, checkAuth: checkAuth}
+}
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+// replay returns the subset of the topic's recent history that should be
+// sent to a newly connected listener before switching to live messages.
+func (h *Handler) replay(topic, since string) ([]Message, error) {
+	if since == "" {
+		return nil, nil
+	}
+
+	messages, err := h.db.GetMessagesByTopic(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	var filtered []db.Message
+	switch {
+	case since == "all":
+		filtered = messages
+	default:
+		if sinceID, err := strconv.ParseInt(since, 10, 64); err == nil {
+			for _, m := range messages {
+				if m.Seq > sinceID {
+					filtered = append(filtered, m)
+				}
+			}
+		} else if d, err := time.ParseDuration(since); err == nil {
+			cutoff := time.Now().Add(-d)
+			for _, m := range messages {
+				createdAt, err := time.Parse(sqliteTimeLayout, m.CreatedAt)
+				if err == nil && createdAt.After(cutoff) {
+					filtered = append(filtered, m)
+				}
+			}
+		} else {
+			return nil, fmt.Errorf("invalid since value %q: must be \"all\", a message id, or a duration", since)
+		}
+	}
+
+	// GetMessagesByTopic returns newest first; replay oldest first.
+	sort.Slice(filtered, func(i, j int) bool { return filtered[i].Seq < filtered[j].Seq })
+
+	out := make([]Message, len(filtered))
+	for i, m := range filtered {
+		out[i] = messageFromDB(m)
+	}
+	return out, nil
+}
+
+// ServeSSE handles GET /{topic}/sse, streaming messages as
+// text/event-stream.
+func (h *Handler) ServeSSE(w http.ResponseWriter, r *http.Request) {
+	topic := chi.URLParam(r, "topic")
+
+	if !h.checkAuth(w, r, topic) {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	replayed, err := h.replay(topic, r.URL.Query().Get("since"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	for _, msg := range replayed {
+		if err := writeSSEMessage(w, msg); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	if r.URL.Query().Get("poll") == "1" {
+		return
+	}
+
+	sub, err := h.hub.Subscribe(topic, "sse")
+	if err != nil {
+		return
+	}
+	defer h.hub.Unsubscribe(sub)
+
+	keepalive := time.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case msg, ok := <-sub.ch:
+			if !ok {
+				return
+			}
+			if err := writeSSEMessage(w, msg); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepalive.C:
+			if _, err := w.Write([]byte(": keepalive\n\n")); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func writeSSEMessage(w http.ResponseWriter, msg Message) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", msg.ID, payload)
+	return err
+}
+
+// ServeWS handles GET /{topic}/ws, upgrading the connection to a
+// WebSocket and streaming messages as JSON text frames.
+func (h *Handler) ServeWS(w http.ResponseWriter, r *http.Request) {
+	topic := chi.URLParam(r, "topic")
+
+	if !h.checkAuth(w, r, topic) {
+		return
+	}
+
+	replayed, err := h.replay(topic, r.URL.Query().Get("since"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("stream: websocket upgrade failed for topic '%s': %v", topic, err)
+		return
+	}
+	defer conn.Close()
+
+	for _, msg := range replayed {
+		if err := conn.WriteJSON(msg); err != nil {
+			return
+		}
+	}
+
+	if r.URL.Query().Get("poll") == "1" {
+		return
+	}
+
+	sub, err := h.hub.Subscribe(topic, "ws")
+	if err != nil {
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error()),
+			time.Now().Add(5*time.Second))
+		return
+	}
+	defer h.hub.Unsubscribe(sub)
+
+	// Drain and discard client frames so control messages (pings/closes)
+	// are handled by the gorilla/websocket library, and detect when the
+	// client goes away.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	keepalive := time.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case msg, ok := <-sub.ch:
+			if !ok {
+				return
+			}
+			if err := conn.WriteJSON(msg); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(5*time.Second)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// ServeJSON handles GET /{topic}/json, streaming messages as
+// newline-delimited JSON (one object per line, flushed immediately),
+// for clients like `curl` or server-side tools that don't speak SSE or
+// WebSocket.
+func (h *Handler) ServeJSON(w http.ResponseWriter, r *http.Request) {
+	topic := chi.URLParam(r, "topic")
+
+	if !h.checkAuth(w, r, topic) {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	replayed, err := h.replay(topic, r.URL.Query().Get("since"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(w)
+	for _, msg := range replayed {
+		if err := encoder.Encode(msg); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	if r.URL.Query().Get("poll") == "1" {
+		return
+	}
+
+	sub, err := h.hub.Subscribe(topic, "json")
+	if err != nil {
+		return
+	}
+	defer h.hub.Unsubscribe(sub)
+
+	keepalive := time.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case msg, ok := <-sub.ch:
+			if !ok {
+				return
+			}
+			if err := encoder.Encode(msg); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepalive.C:
+			if _, err := w.Write([]byte("\n")); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,196 @@
+// Package stream implements an in-memory fan-out hub for live topic
+// listeners (WebSocket and SSE) that sit alongside the web-push delivery
+// path.
+package stream
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"pushem/internal/db"
+)
+
+// keepaliveInterval is how often idle connections receive a keepalive
+// frame so that intermediate proxies don't time them out.
+const keepaliveInterval = 30 * time.Second
+
+// subscriberBuffer bounds how many messages can queue for a slow
+// listener before it is dropped, preventing a single stalled client from
+// growing memory unboundedly.
+const subscriberBuffer = 32
+
+// maxSubscribersPerTopic caps how many live listeners (SSE/WS/JSON
+// combined) a single topic can hold at once, so a flood of long-lived
+// connections to one topic can't leak an unbounded number of goroutines.
+const maxSubscribersPerTopic = 500
+
+// ErrTooManySubscribers is returned by Subscribe when topic already has
+// maxSubscribersPerTopic live listeners attached.
+var ErrTooManySubscribers = errors.New("topic has too many live subscribers")
+
+// Message is the payload fanned out to live listeners for a single
+// published notification. ID is db.Message's internal Seq, not its public
+// "msg_"-prefixed id, so it stays an orderable integer for SSE/WS resume
+// (see Handler.replay and writeSSEMessage's Last-Event-ID field).
+type Message struct {
+	ID        int64  `json:"id"`
+	Topic     string `json:"topic"`
+	Title     string `json:"title"`
+	Message   string `json:"message"`
+	CreatedAt string `json:"created_at"`
+}
+
+func messageFromDB(m db.Message) Message {
+	return Message{
+		ID:        m.Seq,
+		Topic:     m.Topic,
+		Title:     m.Title,
+		Message:   m.Message,
+		CreatedAt: m.CreatedAt,
+	}
+}
+
+// Subscriber is a single live listener attached to a topic.
+type Subscriber struct {
+	topic     string
+	transport string
+	ch        chan Message
+}
+
+// Hub keeps track of live listeners per topic and fans out published
+// messages to them.
+type Hub struct {
+	mu          sync.RWMutex
+	subscribers map[string][]*Subscriber
+	closed      bool
+}
+
+// NewHub creates an empty stream hub.
+func NewHub() *Hub {
+	return &Hub{
+		subscribers: make(map[string][]*Subscriber),
+	}
+}
+
+// Subscribe registers a new live listener for topic and returns it.
+// transport records which endpoint the listener connected through ("sse",
+// "ws", or "json"), purely for LiveSubscriberCounts reporting. The caller
+// must call Unsubscribe when done listening. It returns
+// ErrTooManySubscribers if topic is already at maxSubscribersPerTopic.
+func (h *Hub) Subscribe(topic, transport string) (*Subscriber, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return nil, errors.New("stream hub is shutting down")
+	}
+	if len(h.subscribers[topic]) >= maxSubscribersPerTopic {
+		return nil, ErrTooManySubscribers
+	}
+
+	sub := &Subscriber{
+		topic:     topic,
+		transport: transport,
+		ch:        make(chan Message, subscriberBuffer),
+	}
+	h.subscribers[topic] = append(h.subscribers[topic], sub)
+
+	return sub, nil
+}
+
+// Unsubscribe removes sub from its topic's listener set.
+func (h *Hub) Unsubscribe(sub *Subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	subs := h.subscribers[sub.topic]
+	for i, s := range subs {
+		if s == sub {
+			h.subscribers[sub.topic] = append(subs[:i], subs[i+1:]...)
+			break
+		}
+	}
+	if len(h.subscribers[sub.topic]) == 0 {
+		delete(h.subscribers, sub.topic)
+	}
+}
+
+// Publish fans msg out to every live listener currently attached to
+// msg.Topic. Slow listeners that can't keep up have the message dropped
+// rather than blocking the publisher.
+func (h *Hub) Publish(msg Message) {
+	h.mu.RLock()
+	subs := h.subscribers[msg.Topic]
+	h.mu.RUnlock()
+
+	for _, sub := range subs {
+		select {
+		case sub.ch <- msg:
+		default:
+		}
+	}
+}
+
+// SubscriberCount returns the number of live listeners currently
+// attached to topic.
+func (h *Hub) SubscriberCount(topic string) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.subscribers[topic])
+}
+
+// LiveSubscriberCount is the number of live listeners attached to a single
+// topic through a single transport.
+type LiveSubscriberCount struct {
+	Topic     string
+	Transport string
+	Count     int
+}
+
+// LiveSubscriberCounts returns the current number of live listeners for
+// every (topic, transport) pair that has at least one, for the metrics
+// collector to report as a gauge.
+func (h *Hub) LiveSubscriberCounts() []LiveSubscriberCount {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	counts := make(map[string]map[string]int)
+	for topic, subs := range h.subscribers {
+		for _, sub := range subs {
+			if counts[topic] == nil {
+				counts[topic] = make(map[string]int)
+			}
+			counts[topic][sub.transport]++
+		}
+	}
+
+	var out []LiveSubscriberCount
+	for topic, byTransport := range counts {
+		for transport, count := range byTransport {
+			out = append(out, LiveSubscriberCount{Topic: topic, Transport: transport, Count: count})
+		}
+	}
+	return out
+}
+
+// Close closes every live subscriber's channel, so WebSocket/SSE/JSON
+// handlers blocked reading from it return and let their connections
+// close, and marks the hub closed so Subscribe stops registering new
+// listeners. It is meant to be called once, during graceful shutdown.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return
+	}
+	h.closed = true
+
+	for _, subs := range h.subscribers {
+		for _, sub := range subs {
+			close(sub.ch)
+		}
+	}
+	h.subscribers = make(map[string][]*Subscriber)
+}
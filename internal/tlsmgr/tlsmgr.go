@@ -0,0 +1,142 @@
+// Package tlsmgr lets pushem terminate TLS itself, either by provisioning
+// certificates from Let's Encrypt via autocert or by loading an
+// operator-supplied certificate/key pair. This removes the assumption
+// that pushem always sits behind a TLS-terminating reverse proxy, which
+// matters because VAPID and web-push subscription endpoints only work
+// over HTTPS.
+package tlsmgr
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Config holds the tunables for TLS termination, read from environment
+// variables by LoadConfigFromEnv.
+type Config struct {
+	// ListenHTTPS is the address the HTTPS listener binds to, e.g. ":443".
+	// TLS termination is disabled entirely when this is empty.
+	ListenHTTPS string
+
+	// Hosts enables autocert mode: Let's Encrypt certificates are
+	// requested for exactly these hostnames.
+	Hosts []string
+
+	// CacheDir is where autocert persists issued certificates across
+	// restarts.
+	CacheDir string
+
+	// CertFile/KeyFile enable manual mode for operators using an
+	// externally issued certificate instead of autocert.
+	CertFile string
+	KeyFile  string
+}
+
+// LoadConfigFromEnv builds a Config from LISTEN_HTTPS, TLS_HOSTS,
+// TLS_CACHE_DIR, TLS_CERT_FILE, and TLS_KEY_FILE.
+func LoadConfigFromEnv() Config {
+	cacheDir := os.Getenv("TLS_CACHE_DIR")
+	if cacheDir == "" {
+		cacheDir = "./certs"
+	}
+
+	var hosts []string
+	if raw := os.Getenv("TLS_HOSTS"); raw != "" {
+		for _, host := range strings.Split(raw, ",") {
+			if host = strings.TrimSpace(host); host != "" {
+				hosts = append(hosts, host)
+			}
+		}
+	}
+
+	return Config{
+		ListenHTTPS: os.Getenv("LISTEN_HTTPS"),
+		Hosts:       hosts,
+		CacheDir:    cacheDir,
+		CertFile:    os.Getenv("TLS_CERT_FILE"),
+		KeyFile:     os.Getenv("TLS_KEY_FILE"),
+	}
+}
+
+// Enabled reports whether cfg describes a server that should terminate
+// TLS itself, rather than relying on a reverse proxy.
+func (c Config) Enabled() bool {
+	return c.ListenHTTPS != ""
+}
+
+// Manager serves HTTPS using either an autocert.Manager (when Config.Hosts
+// is set) or a manually supplied certificate/key pair.
+type Manager struct {
+	cfg      Config
+	autocert *autocert.Manager
+}
+
+// New validates cfg and builds the Manager it describes. At least one of
+// autocert mode (Hosts) or manual mode (CertFile/KeyFile) must be
+// configured; when both are, autocert mode is used.
+func New(cfg Config) (*Manager, error) {
+	if len(cfg.Hosts) > 0 {
+		if err := os.MkdirAll(cfg.CacheDir, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create TLS cache dir: %w", err)
+		}
+
+		return &Manager{
+			cfg: cfg,
+			autocert: &autocert.Manager{
+				Prompt:     autocert.AcceptTOS,
+				Cache:      autocert.DirCache(cfg.CacheDir),
+				HostPolicy: autocert.HostWhitelist(cfg.Hosts...),
+			},
+		}, nil
+	}
+
+	if cfg.CertFile != "" && cfg.KeyFile != "" {
+		return &Manager{cfg: cfg}, nil
+	}
+
+	return nil, fmt.Errorf("LISTEN_HTTPS is set but neither TLS_HOSTS nor TLS_CERT_FILE/TLS_KEY_FILE are configured")
+}
+
+// HTTPHandler wraps next with the ACME HTTP-01 challenge handler in
+// autocert mode, so a :80 listener can keep answering
+// /.well-known/acme-challenge/ while redirecting everything else to HTTPS.
+func (m *Manager) HTTPHandler(next http.Handler) http.Handler {
+	if m.autocert != nil {
+		return m.autocert.HTTPHandler(next)
+	}
+	return next
+}
+
+// RedirectHTTP starts an HTTP listener on :80 that redirects every request
+// to HTTPS, answering ACME HTTP-01 challenges directly so certificate
+// issuance and renewal keep working.
+func (m *Manager) RedirectHTTP() error {
+	redirect := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target := "https://" + r.Host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+	})
+
+	return http.ListenAndServe(":80", m.HTTPHandler(redirect))
+}
+
+// ListenAndServeTLS starts the HTTPS listener described by cfg, serving
+// handler over either an autocert-managed certificate or the manual
+// TLS_CERT_FILE/TLS_KEY_FILE pair.
+func (m *Manager) ListenAndServeTLS(handler http.Handler) error {
+	server := &http.Server{
+		Addr:    m.cfg.ListenHTTPS,
+		Handler: handler,
+	}
+
+	if m.autocert != nil {
+		server.TLSConfig = &tls.Config{GetCertificate: m.autocert.GetCertificate}
+		return server.ListenAndServeTLS("", "")
+	}
+
+	return server.ListenAndServeTLS(m.cfg.CertFile, m.cfg.KeyFile)
+}
@@ -0,0 +1,22 @@
+// Package util holds small generic helpers shared across pushem's
+// internal packages that don't belong to any one of them in particular.
+package util
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+)
+
+// RandomStringPrefix returns prefix followed by the hex encoding of
+// length random bytes, so the result is len(prefix)+2*length characters
+// long. It's the "ti_"/"tk_" scheme tiers and bearer tokens already use,
+// pulled out into one place so every prefixed id in the codebase is
+// generated the same way.
+func RandomStringPrefix(prefix string, length int) (string, error) {
+	raw := make([]byte, length)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("failed to generate random id: %w", err)
+	}
+	return prefix + hex.EncodeToString(raw), nil
+}
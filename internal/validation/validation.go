@@ -1,10 +1,15 @@
 package validation
 
 import (
+	"context"
 	"fmt"
+	"net"
+	"net/netip"
 	"net/url"
+	"os"
 	"regexp"
 	"strings"
+	"time"
 	"unicode/utf8"
 )
 
@@ -14,6 +19,9 @@ const (
 	MaxTitleLength   = 256
 	MaxSecretLength  = 256
 	MinSecretLength  = 8
+
+	MaxAttachmentSize       = 100 * 1024 * 1024 // 100 MB
+	MaxAttachmentNameLength = 255
 )
 
 var (
@@ -29,6 +37,15 @@ var (
 		"health":  true,
 		"metrics": true,
 	}
+
+	// Content types rejected for attachments because a browser opening
+	// them directly from the attachment URL would execute them in the
+	// server's origin.
+	forbiddenAttachmentTypes = map[string]bool{
+		"text/html":              true,
+		"application/javascript": true,
+		"image/svg+xml":          true,
+	}
 )
 
 type ValidationError struct {
@@ -101,6 +118,15 @@ func ValidateMessage(title, message string) error {
 	return nil
 }
 
+// ValidatePriority validates a notification priority: 1 (min) through 5
+// (max), following the scale ntfy popularized.
+func ValidatePriority(priority int) error {
+	if priority < 1 || priority > 5 {
+		return &ValidationError{"priority", "priority must be between 1 and 5"}
+	}
+	return nil
+}
+
 // ValidateSecret validates topic secret key
 func ValidateSecret(secret string) error {
 	if secret == "" {
@@ -128,7 +154,69 @@ func ValidateSecret(secret string) error {
 	return nil
 }
 
-// ValidateURL validates subscription endpoint URL
+// resolveTimeout bounds how long ValidateURL will wait on DNS resolution
+// of a subscription endpoint's host.
+const resolveTimeout = 5 * time.Second
+
+// Explicit ranges not already covered by netip.Addr's IsPrivate/IsLoopback/
+// IsLinkLocalUnicast/IsMulticast/IsUnspecified checks below, called out
+// because SSRF protection should not rely solely on the stdlib's RFC 1918/
+// RFC 4193 definition of "private".
+var (
+	cgnatPrefix       = netip.MustParsePrefix("100.64.0.0/10") // RFC 6598 carrier-grade NAT
+	ipv6DiscardPrefix = netip.MustParsePrefix("100::/64")      // RFC 6666
+	ipv6DocPrefix     = netip.MustParsePrefix("2001:db8::/32") // RFC 3849
+)
+
+// IsBlockedAddr reports whether addr is a loopback, private, link-local,
+// multicast, unspecified, CGNAT, or IPv6 documentation/discard address -
+// i.e. an address ValidateURL and the outbound push transports must never
+// connect to, regardless of what hostname resolved to it.
+func IsBlockedAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+
+	if addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() ||
+		addr.IsMulticast() || addr.IsUnspecified() {
+		return true
+	}
+
+	return cgnatPrefix.Contains(addr) || ipv6DiscardPrefix.Contains(addr) || ipv6DocPrefix.Contains(addr)
+}
+
+// endpointAllowed reports whether host is permitted by WEBPUSH_ENDPOINT_ALLOWLIST,
+// a comma-separated list of exact hostnames or "*.suffix" wildcards
+// (e.g. "fcm.googleapis.com,*.notify.windows.com"). An unset or empty
+// allowlist permits any host, deferring entirely to the IP-based checks.
+func endpointAllowed(host string) bool {
+	allowlist := os.Getenv("WEBPUSH_ENDPOINT_ALLOWLIST")
+	if allowlist == "" {
+		return true
+	}
+
+	host = strings.ToLower(host)
+	for _, pattern := range strings.Split(allowlist, ",") {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "" {
+			continue
+		}
+		if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+			if host == suffix || strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+			continue
+		}
+		if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateURL validates a subscription endpoint URL: it must be HTTPS, its
+// host must be covered by WEBPUSH_ENDPOINT_ALLOWLIST (if configured), and
+// every address it resolves to must be a public, routable address -
+// protecting against SSRF via private-range responses, IPv4-mapped IPv6,
+// and hostnames that simply resolve to an internal address.
 func ValidateURL(endpoint string) error {
 	if endpoint == "" {
 		return &ValidationError{"endpoint", "endpoint cannot be empty"}
@@ -144,30 +232,72 @@ func ValidateURL(endpoint string) error {
 		return &ValidationError{"endpoint", "endpoint must use HTTPS"}
 	}
 
-	// Check for potentially dangerous hosts (SSRF protection)
-	host := strings.ToLower(parsed.Hostname())
-
-	// Block localhost and private IPs
-	if host == "localhost" || host == "127.0.0.1" || host == "0.0.0.0" ||
-		strings.HasPrefix(host, "192.168.") ||
-		strings.HasPrefix(host, "10.") ||
-		strings.HasPrefix(host, "172.16.") ||
-		strings.HasPrefix(host, "172.17.") ||
-		strings.HasPrefix(host, "172.18.") ||
-		strings.HasPrefix(host, "172.19.") ||
-		strings.HasPrefix(host, "172.20.") ||
-		strings.HasPrefix(host, "172.21.") ||
-		strings.HasPrefix(host, "172.22.") ||
-		strings.HasPrefix(host, "172.23.") ||
-		strings.HasPrefix(host, "172.24.") ||
-		strings.HasPrefix(host, "172.25.") ||
-		strings.HasPrefix(host, "172.26.") ||
-		strings.HasPrefix(host, "172.27.") ||
-		strings.HasPrefix(host, "172.28.") ||
-		strings.HasPrefix(host, "172.29.") ||
-		strings.HasPrefix(host, "172.30.") ||
-		strings.HasPrefix(host, "172.31.") {
-		return &ValidationError{"endpoint", "endpoint must be a public URL"}
+	host := parsed.Hostname()
+	if host == "" {
+		return &ValidationError{"endpoint", "endpoint must have a host"}
+	}
+
+	if !endpointAllowed(host) {
+		return &ValidationError{"endpoint", "endpoint host is not in WEBPUSH_ENDPOINT_ALLOWLIST"}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return &ValidationError{"endpoint", "failed to resolve endpoint host"}
+	}
+	if len(addrs) == 0 {
+		return &ValidationError{"endpoint", "endpoint host did not resolve to any address"}
+	}
+
+	for _, addr := range addrs {
+		if IsBlockedAddr(addr) {
+			return &ValidationError{"endpoint", "endpoint must be a public URL"}
+		}
+	}
+
+	return nil
+}
+
+// ValidateAttachment validates an uploaded file's name, declared size,
+// and Content-Type before it's handed to a filecache.Cache.
+func ValidateAttachment(filename, contentType string, size int64) error {
+	if filename == "" {
+		return &ValidationError{"attachment", "filename is required"}
+	}
+
+	if len(filename) > MaxAttachmentNameLength {
+		return &ValidationError{"attachment", fmt.Sprintf("filename must be at most %d characters", MaxAttachmentNameLength)}
+	}
+
+	if !utf8.ValidString(filename) {
+		return &ValidationError{"attachment", "filename contains invalid UTF-8"}
+	}
+
+	if strings.ContainsAny(filename, "/\\") || strings.Contains(filename, "..") {
+		return &ValidationError{"attachment", "filename contains invalid characters"}
+	}
+
+	if size <= 0 {
+		return &ValidationError{"attachment", "attachment is empty"}
+	}
+
+	if size > MaxAttachmentSize {
+		return &ValidationError{"attachment", fmt.Sprintf("attachment must be at most %d bytes", MaxAttachmentSize)}
+	}
+
+	if contentType == "" {
+		return &ValidationError{"attachment", "Content-Type is required"}
+	}
+
+	mediaType := contentType
+	if idx := strings.Index(mediaType, ";"); idx != -1 {
+		mediaType = mediaType[:idx]
+	}
+	if forbiddenAttachmentTypes[strings.ToLower(strings.TrimSpace(mediaType))] {
+		return &ValidationError{"attachment", "Content-Type is not allowed"}
 	}
 
 	return nil
@@ -1,20 +1,27 @@
 package webpush
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"math/big"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
 	"time"
 
+	"pushem/internal/metrics"
+	"pushem/internal/validation"
+
 	webpush "github.com/SherClockHolmes/webpush-go"
 	"github.com/golang-jwt/jwt/v5"
 )
@@ -23,6 +30,31 @@ const (
 	vapidKeysFile = "vapid_keys.json"
 )
 
+// ErrSubscriptionExpired indicates the push service has confirmed a
+// subscription is no longer valid (a 410 Gone from the web-push/APNs
+// endpoints, or an UNREGISTERED token from FCM), so db.DB should delete
+// the row rather than keep retrying it.
+var ErrSubscriptionExpired = errors.New("subscription expired")
+
+// Target identifies one subscriber a Transport can deliver to: an
+// Endpoint/P256dh/Auth triple for web push (including APNs, which is just
+// web push against an apple endpoint), or a Token for FCM.
+type Target struct {
+	Endpoint string
+	P256dh   string
+	Auth     string
+	Token    string
+}
+
+// Transport delivers payload to a single subscriber. Service implements it
+// for web push/APNs; internal/fcm implements it for Firebase Cloud
+// Messaging. Handler.Publish picks the right Transport per subscription
+// based on its stored type, so the two can be dispatched concurrently
+// side by side.
+type Transport interface {
+	SendNotification(target Target, payload NotificationPayload) error
+}
+
 type Service struct {
 	privateKey string
 	publicKey  string
@@ -57,11 +89,11 @@ func loadOrGenerateKeys() (*VAPIDKeys, error) {
 			return nil, fmt.Errorf("failed to unmarshal VAPID keys: %w", err)
 		}
 
-		log.Printf("Loaded existing VAPID keys")
+		slog.Info("loaded existing VAPID keys")
 		return &keys, nil
 	}
 
-	log.Println("Generating new VAPID keys...")
+	slog.Info("generating new VAPID keys")
 	privateKey, publicKey, err := generateVAPIDKeys()
 	if err != nil {
 		return nil, err
@@ -81,8 +113,7 @@ func loadOrGenerateKeys() (*VAPIDKeys, error) {
 		return nil, fmt.Errorf("failed to write VAPID keys file: %w", err)
 	}
 
-	log.Printf("Generated new VAPID keys and saved to %s", vapidKeysFile)
-	log.Printf("Public Key: %s", publicKey)
+	slog.Info("generated new VAPID keys", "file", vapidKeysFile, "public_key", publicKey)
 
 	return keys, nil
 }
@@ -118,13 +149,48 @@ func (s *Service) GetPublicKey() string {
 	return s.publicKey
 }
 
+// Action is a single action button rendered by the Web Push Notification
+// API, mapped from db.MessageAction.
+type Action struct {
+	Action string `json:"action"`
+	Title  string `json:"title"`
+	URL    string `json:"url,omitempty"`
+}
+
 type NotificationPayload struct {
 	Title    string `json:"title"`
 	Message  string `json:"message"`
 	ClickURL string `json:"click_url,omitempty"`
+
+	// Priority is 1 (min) through 5 (max), defaulting to 3; it's surfaced
+	// to the service worker so it can pick a rendering (e.g. silent vs.
+	// urgent) the way ntfy's clients do.
+	Priority int `json:"priority,omitempty"`
+
+	// Tags are short labels rendered as an emoji/name prefix when the
+	// client can't otherwise distinguish notification types.
+	Tags []string `json:"tags,omitempty"`
+
+	// Icon is a URL to an image shown alongside the notification.
+	Icon string `json:"icon,omitempty"`
+
+	// Actions are rendered as Web Push Notification API action buttons.
+	Actions []Action `json:"actions,omitempty"`
+
+	// Attachment fields are populated when the notification was
+	// published via PUT /publish/{topic} and reference a file stored in
+	// a filecache.Cache.
+	AttachmentURL  string `json:"attachment_url,omitempty"`
+	AttachmentName string `json:"attachment_name,omitempty"`
+	AttachmentSize int64  `json:"attachment_size,omitempty"`
+	AttachmentType string `json:"attachment_type,omitempty"`
 }
 
-func (s *Service) SendNotification(endpoint, p256dh, auth string, payload NotificationPayload) error {
+// SendNotification implements Transport for web push (and, transparently,
+// APNs, which it detects from the endpoint host).
+func (s *Service) SendNotification(target Target, payload NotificationPayload) error {
+	endpoint, p256dh, auth := target.Endpoint, target.P256dh, target.Auth
+
 	sub := &webpush.Subscription{
 		Endpoint: endpoint,
 		Keys: webpush.Keys{
@@ -143,7 +209,7 @@ func (s *Service) SendNotification(endpoint, p256dh, auth string, payload Notifi
 		// Use custom handler for Apple to ensure proper JWT expiration (< 1h)
 		return s.sendToApple(endpoint, p256dh, auth, payloadBytes)
 	}
-	
+
 	subscriber := os.Getenv("VAPID_SUBJECT")
 	if subscriber == "" {
 		subscriber = "mailto:admin@pushem.local"
@@ -152,127 +218,102 @@ func (s *Service) SendNotification(endpoint, p256dh, auth string, payload Notifi
 		subscriber = "mailto:" + subscriber
 	}
 
+	start := time.Now()
 	resp, err := webpush.SendNotification(payloadBytes, sub, &webpush.Options{
 		Subscriber:      subscriber,
 		VAPIDPrivateKey: s.privateKey,
 		VAPIDPublicKey:  s.publicKey,
 		TTL:             86400,
 	})
+	metrics.PushSendDuration.WithLabelValues("webpush").Observe(time.Since(start).Seconds())
 	if err != nil {
+		metrics.PushSendTotal.WithLabelValues("webpush", "error").Inc()
 		return fmt.Errorf("failed to send notification: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode == 410 {
-		return fmt.Errorf("subscription expired (410 Gone)")
+		metrics.PushSendTotal.WithLabelValues("webpush", "expired").Inc()
+		return fmt.Errorf("%w (410 Gone)", ErrSubscriptionExpired)
 	}
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		body, _ := io.ReadAll(resp.Body)
-		log.Printf("Push service error response: %s", string(body))
+		slog.Warn("push service error response", "endpoint_host", endpointHost(endpoint), "status", resp.StatusCode, "body", string(body))
+		metrics.PushSendTotal.WithLabelValues("webpush", "error").Inc()
 		return fmt.Errorf("push service returned status: %d", resp.StatusCode)
 	}
 
+	metrics.PushSendTotal.WithLabelValues("webpush", "success").Inc()
 	return nil
 }
 
+// endpointHost extracts the push-service host from a subscription endpoint
+// URL, for use in logs without leaking the full per-subscriber path.
+func endpointHost(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
 
-import (
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
-	"encoding/base64"
-	"encoding/json"
-	"fmt"
-	"io"
-	"log"
-	"net/http"
-	"os"
-	"strings"
-	"time"
-
-	webpush "github.com/SherClockHolmes/webpush-go"
-	"github.com/golang-jwt/jwt/v5"
-)
-
-// ... existing code ...
-
+// AppleTransport rewrites the Authorization header of every outgoing
+// request with a fresh, short-lived VAPID JWT. Apple Push Notification
+// service rejects tokens with an expiration further than 1 hour out, so
+// we can't rely on the webpush-go library's default (which is tuned for
+// the generic web-push spec and issues longer-lived tokens).
 type AppleTransport struct {
-	Transport   http.RoundTripper
-	PrivateKey  string
-	PublicKey   string
-	Subscriber  string
+	Transport  http.RoundTripper
+	PrivateKey string
+	PublicKey  string
+	Subscriber string
 }
 
-func (t *AppleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	// Generate new VAPID token with 1h expiration
-	token, err := generateVAPIDToken(t.PrivateKey, t.Subscriber)
+// safeDialContext is a net.Dialer.DialContext replacement that re-resolves
+// addr and refuses to connect to any address validation.IsBlockedAddr
+// flags, as defense in depth against DNS rebinding between the time
+// validation.ValidateURL approved a subscription's endpoint and the time
+// we actually send to it.
+func safeDialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
 	if err != nil {
-		return nil, fmt.Errorf("failed to generate apple vapid token: %w", err)
+		return nil, err
 	}
 
-	// Sign the token (we need to do this manually or use a helper)
-	// Actually, generating the full Authorization header is easier.
-	// Header format: vapid t=jwt, k=pubkey
-	
-	authHeader := fmt.Sprintf("vapid t=%s, k=%s", token, t.PublicKey)
-	req.Header.Set("Authorization", authHeader)
-	
-	// Delegate to original transport
-	transport := t.Transport
-	if transport == nil {
-		transport = http.DefaultTransport
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %w", host, err)
 	}
-	return transport.RoundTrip(req)
-}
 
-func generateVAPIDToken(privateKeyStr, subscriber string) (string, error) {
-	// Decode private key
-	privBytes, err := base64.RawURLEncoding.DecodeString(privateKeyStr)
-	if err != nil {
-		return "", err
+	var dialer net.Dialer
+	var lastErr error
+	for _, ip := range addrs {
+		if validation.IsBlockedAddr(ip) {
+			continue
+		}
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
 	}
-	
-	curve := elliptic.P256()
-	x, y := curve.ScalarBaseMult(privBytes)
-	privKey := &ecdsa.PrivateKey{
-		PublicKey: ecdsa.PublicKey{
-			Curve: curve,
-			X:     x,
-			Y:     y,
-		},
-		D: new(big.Int).SetBytes(privBytes),
-	}
-
-	// Create JWT
-	now := time.Now()
-	claims := jwt.MapClaims{
-		"aud": "https://web.push.apple.com", // Apple requires the generic URL or specific? 
-		// Actually "aud" should be the origin of the endpoint.
-		// But in RoundTrip we know the request URL. 
-		// Wait, "aud" must match the push service origin.
-		// For Apple it is https://web.push.apple.com
-		"exp": now.Add(time.Hour).Unix(), // 1 hour expiration
-		"sub": subscriber,
+
+	if lastErr != nil {
+		return nil, lastErr
 	}
-	
-	// We need to set "aud" dynamically based on request, but here we are in a helper.
-	// Let's move this logic to RoundTrip where we have req.URL.
-	return "", nil 
+	return nil, fmt.Errorf("no public address found for %s", host)
 }
 
-// ... refactoring to put logic in RoundTrip ...
-
 func (t *AppleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	// Origin of the push service
 	origin := fmt.Sprintf("%s://%s", req.URL.Scheme, req.URL.Host)
-	
-	tokenString, err := generateToken(t.PrivateKey, t.Subscriber, origin)
+
+	token, err := generateAppleVAPIDToken(t.PrivateKey, t.Subscriber, origin)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to generate apple vapid token: %w", err)
 	}
 
-	req.Header.Set("Authorization", fmt.Sprintf("vapid t=%s, k=%s", tokenString, t.PublicKey))
+	req.Header.Set("Authorization", fmt.Sprintf("vapid t=%s, k=%s", token, t.PublicKey))
 
 	transport := t.Transport
 	if transport == nil {
@@ -281,12 +322,14 @@ func (t *AppleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	return transport.RoundTrip(req)
 }
 
-func generateToken(privateKeyStr, subscriber, origin string) (string, error) {
+// generateAppleVAPIDToken signs a VAPID JWT with a 45-minute expiration,
+// safely under Apple's 1-hour limit.
+func generateAppleVAPIDToken(privateKeyStr, subscriber, origin string) (string, error) {
 	privBytes, err := base64.RawURLEncoding.DecodeString(privateKeyStr)
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("failed to decode private key: %w", err)
 	}
-	
+
 	curve := elliptic.P256()
 	privKey := new(ecdsa.PrivateKey)
 	privKey.Curve = curve
@@ -295,13 +338,18 @@ func generateToken(privateKeyStr, subscriber, origin string) (string, error) {
 
 	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
 		"aud": origin,
-		"exp": time.Now().Add(45 * time.Minute).Unix(), // 45 min to be safe (<1h)
+		"exp": time.Now().Add(45 * time.Minute).Unix(),
 		"sub": subscriber,
 	})
 
-	return token.SignedString(privKey)
+	signed, err := token.SignedString(privKey)
+	if err != nil {
+		return "", err
+	}
+	metrics.VAPIDTokenGenerationsTotal.Inc()
+	return signed, nil
 }
-	
+
 func (s *Service) sendToApple(endpoint, p256dh, auth string, payload []byte) error {
 	sub := &webpush.Subscription{
 		Endpoint: endpoint,
@@ -310,19 +358,22 @@ func (s *Service) sendToApple(endpoint, p256dh, auth string, payload []byte) err
 			Auth:   auth,
 		},
 	}
-	
+
 	subscriber := os.Getenv("VAPID_SUBJECT")
 	if subscriber == "" {
-		// Use a safe default for Apple? or just the generic one
 		subscriber = "mailto:admin@pushem.local"
 	}
 	if !strings.HasPrefix(subscriber, "mailto:") {
 		subscriber = "mailto:" + subscriber
 	}
 
-	// Use custom transport to intercept and fix VAPID header
+	// Use a custom transport so every request gets a fresh, correctly
+	// scoped Authorization header regardless of what webpush-go computes.
+	// The underlying transport re-validates resolved addresses at dial
+	// time (defense in depth alongside validation.ValidateURL).
 	client := &http.Client{
 		Transport: &AppleTransport{
+			Transport:  &http.Transport{DialContext: safeDialContext},
 			PrivateKey: s.privateKey,
 			PublicKey:  s.publicKey,
 			Subscriber: subscriber,
@@ -330,30 +381,34 @@ func (s *Service) sendToApple(endpoint, p256dh, auth string, payload []byte) err
 		Timeout: 30 * time.Second,
 	}
 
-	resp, err := webpush.SendNotification(payloadBytes, sub, &webpush.Options{
-		// We still pass keys here so the library effectively "works", 
-		// but our Transport will OVERWRITE the Authorization header.
+	start := time.Now()
+	resp, err := webpush.SendNotification(payload, sub, &webpush.Options{
 		Subscriber:      subscriber,
 		VAPIDPrivateKey: s.privateKey,
 		VAPIDPublicKey:  s.publicKey,
 		TTL:             86400,
 		Urgency:         webpush.UrgencyHigh,
-		HTTPClient:      client, 
+		HTTPClient:      client,
 	})
+	metrics.PushSendDuration.WithLabelValues("apns").Observe(time.Since(start).Seconds())
 	if err != nil {
+		metrics.PushSendTotal.WithLabelValues("apns", "error").Inc()
 		return fmt.Errorf("failed to send notification: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode == 410 {
-		return fmt.Errorf("subscription expired (410 Gone)")
+		metrics.PushSendTotal.WithLabelValues("apns", "expired").Inc()
+		return fmt.Errorf("%w (410 Gone)", ErrSubscriptionExpired)
 	}
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		body, _ := io.ReadAll(resp.Body)
-		log.Printf("Push service error response: %s", string(body))
+		slog.Warn("push service error response", "endpoint_host", endpointHost(endpoint), "status", resp.StatusCode, "body", string(body))
+		metrics.PushSendTotal.WithLabelValues("apns", "error").Inc()
 		return fmt.Errorf("push service returned status: %d", resp.StatusCode)
 	}
 
+	metrics.PushSendTotal.WithLabelValues("apns", "success").Inc()
 	return nil
 }